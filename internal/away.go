@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+// AwayPeriod represents a scheduled period of away mode, eg. a vacation.
+type AwayPeriod struct {
+	// From and To are in RFC3339 format.
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Parsed and processed configuration information.
+
+	// From and To as time.Time.
+	FromTime, ToTime time.Time `json:"-"`
+}
+
+func (p *AwayPeriod) parse() error {
+	var err error
+	if p.FromTime, err = time.Parse(time.RFC3339, p.From); err != nil {
+		return fmt.Errorf("failed to parse away_schedule from %q in RFC3339 format: %v", p.From, err)
+	}
+	if p.ToTime, err = time.Parse(time.RFC3339, p.To); err != nil {
+		return fmt.Errorf("failed to parse away_schedule to %q in RFC3339 format: %v", p.To, err)
+	}
+	if !p.ToTime.After(p.FromTime) {
+		return fmt.Errorf("away_schedule period %v to %v is empty", p.From, p.To)
+	}
+	return nil
+}
+
+// Contains returns true if the specified time is within the period.
+func (p *AwayPeriod) Contains(when time.Time) bool {
+	return !when.Before(p.FromTime) && when.Before(p.ToTime)
+}
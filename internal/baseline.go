@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// HoursPerWeek is the number of hours of the week tracked by a Baseline.
+const HoursPerWeek = 7 * 24
+
+// HourOfWeek returns the hour of the week, from 0 for midnight to 1am on
+// Sunday, of the specified time in that time's location.
+func HourOfWeek(when time.Time) int {
+	return int(when.Weekday())*24 + when.Hour()
+}
+
+// Baseline represents the typical usage of a meter, in pulses, for each
+// hour of the week as learnt from its timestamp file.
+type Baseline struct {
+	// Built is the time the baseline was built and Weeks the number of
+	// weeks of history it was built from.
+	Built time.Time
+	Weeks int
+	// Mean, StdDev and Minimum are the mean, standard deviation and
+	// minimum of the number of pulses in each hour of the week and
+	// Samples the number of hours that they were calculated from.
+	Mean    [HoursPerWeek]float64
+	StdDev  [HoursPerWeek]float64
+	Minimum [HoursPerWeek]int
+	Samples [HoursPerWeek]int
+}
+
+// BuildBaseline builds a Baseline from the timestamps recorded in the
+// specified timestamp file over the specified number of weeks prior to
+// end. Only hours after the first recorded timestamp are included so that
+// a new file does not appear to record a period of no usage.
+func BuildBaseline(filename string, end time.Time, weeks int) (*Baseline, error) {
+	end = end.Truncate(time.Hour)
+	start := end.Add(-time.Duration(weeks) * 7 * 24 * time.Hour)
+	b := &Baseline{Built: end, Weeks: weeks}
+	rd, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return b, nil
+		}
+		return nil, err
+	}
+	defer rd.Close()
+	counts := map[int64]int{}
+	var first time.Time
+	sc := NewTimestampFileScanner(rd)
+	for sc.Scan() {
+		ts := sc.Time()
+		if first.IsZero() {
+			first = ts
+		}
+		if ts.Before(start) {
+			continue
+		}
+		if !ts.Before(end) {
+			break
+		}
+		counts[ts.Truncate(time.Hour).Unix()]++
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading %v: %v", filename, err)
+	}
+	if first.IsZero() {
+		return b, nil
+	}
+	var sum, sumSq [HoursPerWeek]float64
+	for hour := start; hour.Before(end); hour = hour.Add(time.Hour) {
+		if hour.Before(first.Truncate(time.Hour)) {
+			continue
+		}
+		how := HourOfWeek(hour.In(end.Location()))
+		c := counts[hour.Unix()]
+		if b.Samples[how] == 0 || c < b.Minimum[how] {
+			b.Minimum[how] = c
+		}
+		n := float64(c)
+		sum[how] += n
+		sumSq[how] += n * n
+		b.Samples[how]++
+	}
+	for how := range sum {
+		if n := float64(b.Samples[how]); n > 0 {
+			b.Mean[how] = sum[how] / n
+			b.StdDev[how] = math.Sqrt(math.Max(sumSq[how]/n-b.Mean[how]*b.Mean[how], 0))
+		}
+	}
+	return b, nil
+}
+
+// Expected returns the expected number of pulses between start and end,
+// which are truncated to the hour, and the standard deviation thereof,
+// assuming that each hour is independent. It returns false if any of the
+// hours has fewer than minSamples samples.
+func (b *Baseline) Expected(start, end time.Time, minSamples int) (float64, float64, bool) {
+	var mean, variance float64
+	for hour := start.Truncate(time.Hour); hour.Before(end.Truncate(time.Hour)); hour = hour.Add(time.Hour) {
+		how := HourOfWeek(hour)
+		if b.Samples[how] < minSamples {
+			return 0, 0, false
+		}
+		mean += b.Mean[how]
+		variance += b.StdDev[how] * b.StdDev[how]
+	}
+	return mean, math.Sqrt(variance), true
+}
+
+// ZScore returns the number of standard deviations by which the specified
+// number of pulses differs from the specified mean. The standard
+// deviation is taken to be at least one pulse so that the score is not
+// inflated by periods that are always idle.
+func ZScore(pulses, mean, stddev float64) float64 {
+	return (pulses - mean) / math.Max(stddev, 1)
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildBaseline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 4th July 2020 is a Saturday, hour 156 of the week is Saturday from
+	// noon until 1pm.
+	at := func(mo time.Month, d, h, m int) time.Time { return time.Date(2020, mo, d, h, m, 0, 0, time.UTC) }
+	end := at(7, 4, 12, 30)
+	pulses := func(when time.Time, n int) []time.Time {
+		var times []time.Time
+		for i := 0; i < n; i++ {
+			times = append(times, when.Add(time.Duration(i)*time.Minute))
+		}
+		return times
+	}
+	concat := func(times ...[]time.Time) []time.Time {
+		var all []time.Time
+		for _, t := range times {
+			all = append(all, t...)
+		}
+		return all
+	}
+	early := pulses(at(6, 13, 13, 0), 1)
+	weekA := pulses(at(6, 20, 13, 10), 2)
+	weekB := pulses(at(6, 27, 13, 10), 4)
+	late := pulses(at(7, 4, 12, 0), 3)
+
+	type hour struct {
+		how, samples, minimum int
+		mean, stddev          float64
+	}
+	for i, tc := range []struct {
+		name  string
+		times []time.Time
+		weeks int
+		hours []hour
+	}{
+		{"missing", nil, 2, []hour{{156, 0, 0, 0, 0}, {157, 0, 0, 0, 0}}},
+		{"empty", []time.Time{}, 2, []hour{{156, 0, 0, 0, 0}, {157, 0, 0, 0, 0}}},
+		{"two weeks", concat(early, weekA, weekB, late), 2, []hour{
+			{156, 2, 0, 0, 0},
+			{157, 2, 2, 3, 1},
+			{158, 2, 0, 0, 0},
+			{0, 2, 0, 0, 0},
+		}},
+		{"one week", concat(early, weekA, weekB, late), 1, []hour{
+			{156, 1, 0, 0, 0},
+			{157, 1, 4, 4, 0},
+			{0, 1, 0, 0, 0},
+		}},
+		// Hours before the first timestamp are not counted.
+		{"starts within the first week", concat(weekA, weekB), 2, []hour{
+			{156, 1, 0, 0, 0},
+			{157, 2, 2, 3, 1},
+			{0, 2, 0, 0, 0},
+		}},
+		{"starts within the second week", weekB, 2, []hour{
+			{156, 0, 0, 0, 0},
+			{157, 1, 4, 4, 0},
+			{143, 1, 0, 0, 0},
+		}},
+	} {
+		filename := filepath.Join(dir, tc.name+".ts")
+		if tc.times != nil {
+			wr, err := NewTimestampFileWriter(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ts := range tc.times {
+				if err := wr.Append(ts); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wr.Close()
+		}
+		b, err := BuildBaseline(filename, end, tc.weeks)
+		if err != nil {
+			t.Fatalf("%v: %v: %v", i, tc.name, err)
+		}
+		if got, want := b.Built, end.Truncate(time.Hour); !got.Equal(want) {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.name, got, want)
+		}
+		for _, h := range tc.hours {
+			got := hour{h.how, b.Samples[h.how], b.Minimum[h.how], b.Mean[h.how], b.StdDev[h.how]}
+			if got != h {
+				t.Errorf("%v: %v: got %+v, want %+v", i, tc.name, got, h)
+			}
+		}
+	}
+}
+
+func TestBaselineExpected(t *testing.T) {
+	b := &Baseline{}
+	// Saturday from 1pm to 3pm.
+	b.Samples[157], b.Mean[157], b.StdDev[157] = 2, 3, 1
+	b.Samples[158], b.Mean[158], b.StdDev[158] = 3, 1, 2
+	at := func(h, m int) time.Time { return time.Date(2020, 7, 4, h, m, 0, 0, time.UTC) }
+	for i, tc := range []struct {
+		start, end   time.Time
+		minSamples   int
+		mean, stddev float64
+		ok           bool
+	}{
+		{at(13, 0), at(13, 0), 2, 0, 0, true},
+		{at(13, 0), at(14, 0), 2, 3, 1, true},
+		{at(13, 0), at(15, 0), 2, 4, math.Sqrt(5), true},
+		// The start and end are truncated to the hour.
+		{at(13, 15), at(14, 45), 2, 3, 1, true},
+		{at(13, 45), at(15, 15), 2, 4, math.Sqrt(5), true},
+		{at(14, 0), at(15, 0), 3, 1, 2, true},
+		{at(13, 0), at(15, 0), 3, 0, 0, false},
+		{at(12, 0), at(14, 0), 1, 0, 0, false},
+		{at(13, 0), at(16, 0), 1, 0, 0, false},
+	} {
+		mean, stddev, ok := b.Expected(tc.start, tc.end, tc.minSamples)
+		if mean != tc.mean || stddev != tc.stddev || ok != tc.ok {
+			t.Errorf("%v: %v-%v: got %v, %v, %v, want %v, %v, %v", i, tc.start, tc.end, mean, stddev, ok, tc.mean, tc.stddev, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the current time and timers, it allows time based logic
+// to be tested without waiting for real time to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel on which the time is sent once the
+	// specified duration has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock provided by the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SimulatedClock is a Clock whose time only changes when it is explicitly
+// advanced, any timers that expire as a result are fired in order. It is
+// safe for concurrent use.
+type SimulatedClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []simulatedTimer
+}
+
+type simulatedTimer struct {
+	when time.Time
+	ch   chan time.Time
+}
+
+// simulatedSettleTime is the longest that a SimulatedClock waits, after
+// firing a timer, for the goroutine that receives from it to set its next
+// timer.
+const simulatedSettleTime = 10 * time.Millisecond
+
+// NewSimulatedClock creates a SimulatedClock set to the specified time.
+func NewSimulatedClock(now time.Time) *SimulatedClock {
+	return &SimulatedClock{now: now}
+}
+
+// Now implements Clock.
+func (c *SimulatedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After implements Clock.
+func (c *SimulatedClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	when := c.now.Add(d)
+	i := sort.Search(len(c.timers), func(i int) bool { return c.timers[i].when.After(when) })
+	c.timers = append(c.timers, simulatedTimer{})
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = simulatedTimer{when: when, ch: ch}
+	return ch
+}
+
+// Advance advances the clock by the specified duration, firing any
+// timers that expire along the way with the clock set to the time at
+// which each expires. The timers are fired one at a time and, after
+// each, Advance waits briefly for the goroutine that receives from it to
+// set its next timer before moving on. Hence a goroutine that sets a new
+// timer each time that its previous one fires, such as one that evaluates
+// alert rules every minute, runs as many times as it would have done in
+// real time however far the clock is advanced in a single call.
+func (c *SimulatedClock) Advance(d time.Duration) {
+	c.AdvanceTo(c.Now().Add(d))
+}
+
+// AdvanceTo advances the clock to the specified time, in the same manner
+// as Advance, unless the clock is already at or beyond that time.
+func (c *SimulatedClock) AdvanceTo(end time.Time) {
+	for {
+		c.mu.Lock()
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			if end.After(c.now) {
+				c.now = end
+			}
+			c.mu.Unlock()
+			return
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		pending := len(c.timers)
+		c.mu.Unlock()
+		t.ch <- t.when
+		c.settle(t.ch, pending)
+	}
+}
+
+// settle waits for the timer that was sent on ch to be received and for
+// a new timer to be set, or for simulatedSettleTime to elapse.
+func (c *SimulatedClock) settle(ch chan time.Time, pending int) {
+	deadline := time.Now().Add(simulatedSettleTime)
+	for time.Now().Before(deadline) {
+		if len(ch) == 0 && c.Timers() > pending {
+			return
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+}
+
+// Timers returns the number of timers that have yet to fire, it can be
+// used to wait for goroutines to block on the clock before advancing it.
+func (c *SimulatedClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
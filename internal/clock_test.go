@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimulatedClock(t *testing.T) {
+	start := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	clock := NewSimulatedClock(start)
+
+	// Timers are created out of order and must fire in order of expiry
+	// with the clock set to the time at which each expires.
+	durations := []time.Duration{3 * time.Second, time.Second, 2 * time.Second, 2 * time.Second, time.Minute}
+	timers := make([]<-chan time.Time, len(durations))
+	for i, d := range durations {
+		timers[i] = clock.After(d)
+	}
+	for i := 1; i < len(clock.timers); i++ {
+		if clock.timers[i].when.Before(clock.timers[i-1].when) {
+			t.Errorf("timers are out of order: %v before %v", clock.timers[i-1].when, clock.timers[i].when)
+		}
+	}
+
+	for i, tc := range []struct {
+		advance time.Duration
+		fired   []int
+		pending int
+	}{
+		{0, nil, 5},
+		{500 * time.Millisecond, nil, 5},
+		{500 * time.Millisecond, []int{1}, 4},
+		{1500 * time.Millisecond, []int{2, 3}, 2},
+		{10 * time.Second, []int{0}, 1},
+		{time.Hour, []int{4}, 0},
+	} {
+		before := clock.Now()
+		clock.Advance(tc.advance)
+		if got, want := clock.Now(), before.Add(tc.advance); !got.Equal(want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		fired := map[int]bool{}
+		for _, f := range tc.fired {
+			fired[f] = true
+		}
+		for j, ch := range timers {
+			select {
+			case when := <-ch:
+				if !fired[j] {
+					t.Errorf("%v: timer %v fired unexpectedly", i, j)
+				}
+				if got, want := when, start.Add(durations[j]); !got.Equal(want) {
+					t.Errorf("%v: timer %v: got %v, want %v", i, j, got, want)
+				}
+			default:
+				if fired[j] {
+					t.Errorf("%v: timer %v did not fire", i, j)
+				}
+			}
+		}
+		if got, want := clock.Timers(), tc.pending; got != want {
+			t.Errorf("%v: got %v pending timers, want %v", i, got, want)
+		}
+	}
+
+	// Timers for zero or negative durations fire immediately.
+	now := clock.Now()
+	for _, d := range []time.Duration{0, -time.Second} {
+		select {
+		case when := <-clock.After(d):
+			if !when.Equal(now) {
+				t.Errorf("%v: got %v, want %v", d, when, now)
+			}
+		default:
+			t.Errorf("%v: timer did not fire immediately", d)
+		}
+	}
+
+	// AdvanceTo never moves the clock backwards.
+	clock.AdvanceTo(now.Add(-time.Hour))
+	if got := clock.Now(); !got.Equal(now) {
+		t.Errorf("got %v, want %v", got, now)
+	}
+	ch := clock.After(time.Minute)
+	clock.AdvanceTo(now.Add(time.Hour))
+	if got, want := clock.Now(), now.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := <-ch, now.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSimulatedClockRearm(t *testing.T) {
+	start := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	clock := NewSimulatedClock(start)
+
+	// A goroutine that sets a new timer each time its previous one fires
+	// must see every one of them fire however far the clock is advanced.
+	ticks := make(chan time.Time, 2000)
+	done := make(chan struct{})
+	go func() {
+		defer close(ticks)
+		timer := clock.After(time.Minute)
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-timer:
+				ticks <- now
+				timer = clock.After(time.Minute)
+			}
+		}
+	}()
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(24 * time.Hour)
+	close(done)
+	n := 0
+	for now := range ticks {
+		n++
+		if want := start.Add(time.Duration(n) * time.Minute); !now.Equal(want) {
+			t.Fatalf("tick %v: got %v, want %v", n, now, want)
+		}
+	}
+	if got, want := n, 24*60; got != want {
+		t.Errorf("got %v ticks, want %v", got, want)
+	}
+}
+
+func TestUntilHHMM(t *testing.T) {
+	hhmm, err := time.Parse("15:04 -0700", "07:00 -0700")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdt := time.FixedZone("PDT", -7*60*60)
+	for i, tc := range []struct {
+		now   time.Time
+		until time.Duration
+	}{
+		{time.Date(2020, 7, 4, 6, 0, 0, 0, pdt), time.Hour},
+		{time.Date(2020, 7, 4, 6, 59, 30, 0, pdt), 30 * time.Second},
+		{time.Date(2020, 7, 4, 7, 0, 0, 0, pdt), 24 * time.Hour},
+		{time.Date(2020, 7, 4, 7, 1, 0, 0, pdt), 23*time.Hour + 59*time.Minute},
+		{time.Date(2020, 7, 4, 23, 0, 0, 0, pdt), 8 * time.Hour},
+		// 07:00 -0700 is 14:00 UTC.
+		{time.Date(2020, 7, 4, 13, 0, 0, 0, time.UTC), time.Hour},
+		{time.Date(2020, 7, 4, 15, 0, 0, 0, time.UTC), 23 * time.Hour},
+		{time.Date(2020, 12, 31, 23, 0, 0, 0, time.UTC), 15 * time.Hour},
+	} {
+		if got, want := UntilHHMM(tc.now, hhmm), tc.until; got != want {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.now, got, want)
+		}
+	}
+}
+
+func TestUntilHHMMDST(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 07:00 in Pacific Standard Time.
+	hhmm, err := time.Parse("15:04 -0700", "07:00 -0800")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(mo time.Month, d, h, m int) time.Time { return time.Date(2020, mo, d, h, m, 0, 0, la) }
+	for i, tc := range []struct {
+		now, next time.Time
+	}{
+		{at(1, 15, 6, 0), at(1, 15, 7, 0)},
+		{at(7, 4, 6, 0), at(7, 4, 7, 0)},
+		{at(7, 4, 7, 0), at(7, 5, 7, 0)},
+		// Daylight savings time starts at 02:00 on the 8th of March and
+		// ends at 02:00 on the 1st of November 2020.
+		{at(3, 7, 7, 0), at(3, 8, 7, 0)},
+		{at(3, 8, 1, 0), at(3, 8, 7, 0)},
+		{at(3, 8, 7, 0), at(3, 9, 7, 0)},
+		{at(10, 31, 7, 0), at(11, 1, 7, 0)},
+		{at(11, 1, 1, 30), at(11, 1, 7, 0)},
+		{at(11, 1, 7, 0), at(11, 2, 7, 0)},
+	} {
+		if got, want := tc.now.Add(UntilHHMMDST(tc.now, hhmm, time.Hour)), tc.next; !got.Equal(want) {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.now, got, want)
+		}
+	}
+	// Without an adjustment the time is fixed in standard time.
+	if got, want := at(7, 4, 6, 0).Add(UntilHHMMDST(at(7, 4, 6, 0), hhmm, 0)), at(7, 4, 8, 0); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
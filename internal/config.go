@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -20,6 +21,9 @@ func init() {
 }
 
 // Configuration represents the configuration for the pulsemon family of tools.
+// The embedded MeterConfig is used to configure a single meter when
+// no Meters are specified and provides the default values for each of
+// the Meters otherwise.
 type Configuration struct {
 	// SMTP configuration for alert emails.
 	Server  string   `json:"smtp_server"`
@@ -33,9 +37,64 @@ type Configuration struct {
 	StatusEmailTime    string `json:"status_email_time"`
 	StatusEmailSubject string `json:"status_email_subject"`
 
-	// DST offset for the required timezone as a string in time.Duration format.
+	// Send a status email when the monitor is stopped.
+	StoppedEmail bool `json:"stopped_email"`
+
+	// Away mode applies each meter's away rules whilst the house is empty.
+	// It is active whilst Away is set, during any of the AwaySchedule
+	// periods or once toggled on by the AwayButtonPin input (-1, the
+	// default, to disable) or the monitor's API.
+	Away          bool         `json:"away"`
+	AwaySchedule  []AwayPeriod `json:"away_schedule"`
+	AwayButtonPin int          `json:"away_button_pin"`
+
+	// DST offset for the required timezone as a string in time.Duration format,
+	// it is added to the UTC offset of StatusEmailTime whilst daylight
+	// savings time is in effect.
 	DSTAdjustment string `json:"daylight_savings_adjustment"`
 
+	// Number of gallons per pulse, retained for backwards compatibility,
+	// units_per_pulse takes precedence.
+	GallonsPerPulse int `json:"gallons_per_pulse"`
+
+	MeterConfig
+
+	// The meters to monitor, each one inherits any values not specified
+	// for it from the top-level configuration.
+	MetersJSON []json.RawMessage `json:"meters"`
+
+	// Parsed and processed configuration information.
+
+	// StatusEmailTime as a time.Time.
+	StatusTime time.Time
+	// DSTAdjustment as a time.Duration.
+	DSTAdjustmentDuration time.Duration
+
+	// The parsed meter configurations, there is always at least one.
+	Meters []MeterConfig `json:"-"`
+
+	PollingInterval int `json:"polling_interval_ms"`
+
+	// Hardware to use, one of "piface" (the default), "simulated" or "none".
+	Hardware string `json:"hardware"`
+
+	// Scripted input transitions for the simulated hardware, optionally
+	// repeated indefinitely.
+	SimulatedInput  []SimulatedTransition `json:"simulated_input"`
+	SimulatedRepeat bool                  `json:"simulated_repeat"`
+}
+
+// MeterConfig represents the configuration for a single meter.
+type MeterConfig struct {
+	// Name identifies the meter in all alerts, emails and reports.
+	Name string `json:"name"`
+
+	// Units is the name of the units measured by the meter, eg. gallons,
+	// and UnitsPerPulse the number of units, which may be fractional,
+	// eg. 0.1 cubic metres, that each pulse represents.
+	Units         string  `json:"units"`
+	UnitsPerPulse float64 `json:"units_per_pulse"`
+
 	// Alert configuation, if more than AlertPulses are counted
 	// over AlertInterval then an email is sent.
 	AlertInterval     string `json:"alert_interval"`
@@ -43,30 +102,92 @@ type Configuration struct {
 	LeakAlertInterval string `json:"leak_alert_interval"`
 	AlertPulses       int64  `json:"alert_pulses"`
 
-	// Number of gallons per pulse.
-	GallonsPerPulse int `json:"gallons_per_pulse"`
+	// Alert rules, if none are specified then rules equivalent to the
+	// above alert configuration are used, in which case it is required.
+	AlertRules []AlertRule `json:"alert_rules"`
+
+	// Alert rules that only apply whilst away mode is active, if none
+	// are specified then a critical rate_above rule that fires when more
+	// than AwayAllowance pulses occur within an hour, and that closes the
+	// shut-off valve if AwayShutoff is set, is used.
+	AwayRules     []AlertRule `json:"away_rules"`
+	AwayAllowance int64       `json:"away_allowance"`
+	AwayShutoff   bool        `json:"away_shutoff"`
+
+	// Optionally learn a baseline of typical usage for each hour of the
+	// week from the specified number of weeks of the timestamp file, it
+	// is required by baseline alert rules.
+	BaselineWeeks int `json:"baseline_weeks"`
+
+	// Optionally close a motorised shut-off valve, via the relay
+	// ShutoffRelayPin (-1, the default, to disable), when any alert or
+	// away rule with shutoff set starts to fire. The valve is latched
+	// closed until it is explicitly reset and is closed at most
+	// ShutoffMaxActuations times, if set, within ShutoffActuationPeriod
+	// (24h by default) so that a misconfigured rule cannot repeatedly
+	// cut off the supply. The latch, and recent actuations, are recorded
+	// in ShutoffStateFile, if set, so that they persist across restarts.
+	ShutoffRelayPin        int    `json:"shutoff_relay_pin"`
+	ShutoffMaxActuations   int    `json:"shutoff_max_actuations"`
+	ShutoffActuationPeriod string `json:"shutoff_actuation_period"`
+	ShutoffStateFile       string `json:"shutoff_state_file"`
+
+	// A leak test, started on demand whilst no water is being used,
+	// lasts for LeakTestDuration (15m by default) and passes if no more
+	// than LeakTestAllowance pulses are seen. The results are appended
+	// to LeakTestFile, if set, for later review.
+	LeakTestDuration  string `json:"leak_test_duration"`
+	LeakTestAllowance int64  `json:"leak_test_allowance"`
+	LeakTestFile      string `json:"leak_test_file"`
 
 	// Record the time of each pulse in binary, little endian, 64 bit unix
 	// nanoseconds.
 	PulseTimestampFile string `json:"pulse_timestamps_file"`
 
-	// Parsed and processed configuration information.
-
-	// AlertInterval as a time.Duration.
-	AlertDuration time.Duration
-
-	// IdleAlertInterval as a time.Duration
-	IdleAlertDuration time.Duration
-
-	// LeakAlertInterval as a time.Duration
-	LeakAlertDuration time.Duration
-
-	// StatusEmailTime as a time.Time.
-	StatusTime time.Time
-	// DSTAdjustment as a time.Duration.
-	DSTAdjustmentDuration time.Duration
-
-	PollingInterval int `json:"polling_interval_ms"`
+	// Debounce algorithm to use, one of "counter" (the default),
+	// "integrator" or "min-interval". The latter requires MaxFlowRate, the
+	// maximum physical flow rate of the meter in units per minute, from
+	// which the minimum interval between pulses is derived.
+	Debounce    string  `json:"debounce"`
+	MaxFlowRate float64 `json:"max_flow_rate"`
+
+	// When polling, pulses are timestamped with the time of the first
+	// closed sample; set PulseTimestampMidpoint to use the midpoint
+	// between that sample and the preceding open one instead.
+	PulseTimestampMidpoint bool `json:"pulse_timestamp_midpoint"`
+
+	// Optionally track the meter's register, ie. the reading shown on the
+	// physical meter. RegisterFile records the most recent reading of the
+	// physical register and is created from InitialRegister, read at
+	// InitialRegisterTime (in RFC3339 format, defaulting to startup time),
+	// if it does not exist.
+	RegisterFile        string  `json:"register_file"`
+	InitialRegister     float64 `json:"initial_register"`
+	InitialRegisterTime string  `json:"initial_register_time"`
+
+	// Optionally record the rising and falling edge times of each pulse
+	// as pairs of timestamps in the same format as PulseTimestampFile.
+	PulseWidthsFile string `json:"pulse_widths_file"`
+
+	// Input backend to read pulses from, either "board" (the default) to
+	// use InputPin on the configured hardware, "gpio" to use a line
+	// on a Linux GPIO character device or "replay" to replay a previously
+	// recorded timestamp file.
+	InputBackend string `json:"input_backend"`
+
+	// Timestamp file to replay and the speed to replay it at, 1 (the
+	// default) for real time, 60 for an hour per minute etc. Either all
+	// or none of the meters must replay, at the same speed.
+	ReplayFile  string  `json:"replay_file"`
+	ReplaySpeed float64 `json:"replay_speed"`
+
+	// Linux GPIO character device configuration: chip (eg. gpiochip0),
+	// line offset, bias (pull-up, pull-down, disable or as-is) and whether
+	// the line is active low.
+	GPIOChip      string `json:"gpio_chip"`
+	GPIOLine      int    `json:"gpio_line"`
+	GPIOBias      string `json:"gpio_bias"`
+	GPIOActiveLow bool   `json:"gpio_active_low"`
 
 	// Hardware specific configuration, doesn't really belong here. Set to
 	// -1 to disable.
@@ -76,52 +197,376 @@ type Configuration struct {
 	OutputRelayHoldMS int `json:"relay_hold_ms"`
 	OutputPin         int `json:"output_pin"`
 	OutputPinHoldMS   int `json:"output_hold_ms"`
+
+	// Parsed and processed configuration information.
+
+	// AlertInterval as a time.Duration.
+	AlertDuration time.Duration `json:"-"`
+
+	// IdleAlertInterval as a time.Duration
+	IdleAlertDuration time.Duration `json:"-"`
+
+	// LeakAlertInterval as a time.Duration
+	LeakAlertDuration time.Duration `json:"-"`
+
+	// ShutoffActuationPeriod as a time.Duration.
+	ShutoffActuationDuration time.Duration `json:"-"`
+
+	// LeakTestDuration as a time.Duration.
+	LeakTestDefaultDuration time.Duration `json:"-"`
 }
 
+// Default name and units for a meter.
+const (
+	DefaultMeterName  = "water"
+	DefaultMeterUnits = "gallons"
+)
+
 // ReadConfig reads the configuration from the specified file.
 func ReadConfig(filename string, config *Configuration) error {
 	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return fmt.Errorf("failed to read: %v", filename)
 	}
+	config.AwayButtonPin = -1
+	config.ShutoffRelayPin = -1
 	if err := json.Unmarshal(buf, config); err != nil {
 		return fmt.Errorf("failed to unmarshal %v: %v", filename, err)
 	}
+	for i := range config.AwaySchedule {
+		if err := config.AwaySchedule[i].parse(); err != nil {
+			return err
+		}
+	}
 
-	interval, err := time.ParseDuration(config.AlertInterval)
+	emailAt, err := time.Parse("15:04 -0700", config.StatusEmailTime)
 	if err != nil {
-		return fmt.Errorf("failed to parse alert_interval %q as time.Duration: %v", config.AlertInterval, err)
+		return fmt.Errorf("failed to parse %q in 15:04 -0700 format", config.StatusEmailTime)
 	}
-
-	idle, err := time.ParseDuration(config.IdleAlertInterval)
+	config.DSTAdjustmentDuration, err = time.ParseDuration(config.DSTAdjustment)
 	if err != nil {
-		return fmt.Errorf("failed to parse idle_alert_interval %q as time.Duration: %v", config.IdleAlertInterval, err)
+		return fmt.Errorf("failed to parse %q as a time.Duration", config.DSTAdjustment)
+	}
+	config.StatusTime = emailAt
+
+	if len(config.Name) == 0 {
+		config.Name = DefaultMeterName
+	}
+	if len(config.Units) == 0 {
+		config.Units = DefaultMeterUnits
+	}
+	if config.UnitsPerPulse == 0 {
+		config.UnitsPerPulse = float64(config.GallonsPerPulse)
 	}
 
-	leak, err := time.ParseDuration(config.LeakAlertInterval)
+	if len(config.MetersJSON) == 0 {
+		config.Meters = []MeterConfig{config.MeterConfig}
+	}
+	for i, raw := range config.MetersJSON {
+		meter := config.MeterConfig
+		meter.Name = ""
+		// Unmarshal decodes into the existing elements of a slice, so
+		// clear the inherited rules to avoid overwriting those of the
+		// top-level configuration, and hence of other meters, and to
+		// avoid inheriting fields that the meter's own rules omit.
+		meter.AlertRules, meter.AwayRules = nil, nil
+		if err := json.Unmarshal(raw, &meter); err != nil {
+			return fmt.Errorf("failed to unmarshal meter %v in %v: %v", i, filename, err)
+		}
+		if meter.AlertRules == nil {
+			meter.AlertRules = config.AlertRules
+		}
+		if meter.AwayRules == nil {
+			meter.AwayRules = config.AwayRules
+		}
+		if len(meter.Name) == 0 {
+			return fmt.Errorf("meter %v in %v has no name", i, filename)
+		}
+		config.Meters = append(config.Meters, meter)
+	}
+
+	names := map[string]bool{}
+	files := map[string]bool{}
+	// The meters that use each board input pin and GPIO line and to
+	// which each relay and output pin forwards pulses.
+	pins := map[int]string{}
+	lines := map[string]string{}
+	relays := map[int]string{}
+	outputs := map[int]string{}
+	if config.AwayButtonPin >= 0 {
+		pins[config.AwayButtonPin] = "the away mode button"
+	}
+	for i := range config.Meters {
+		meter := &config.Meters[i]
+		if names[meter.Name] {
+			return fmt.Errorf("duplicate meter name: %v", meter.Name)
+		}
+		names[meter.Name] = true
+		if files[meter.PulseTimestampFile] {
+			return fmt.Errorf("meter %v: pulse_timestamps_file %v is used by more than one meter", meter.Name, meter.PulseTimestampFile)
+		}
+		files[meter.PulseTimestampFile] = true
+		if len(meter.PulseWidthsFile) > 0 {
+			if files[meter.PulseWidthsFile] {
+				return fmt.Errorf("meter %v: pulse_widths_file %v is used by more than one meter", meter.Name, meter.PulseWidthsFile)
+			}
+			files[meter.PulseWidthsFile] = true
+		}
+		if len(meter.RegisterFile) > 0 {
+			if files[meter.RegisterFile] {
+				return fmt.Errorf("meter %v: register_file %v is used by more than one meter", meter.Name, meter.RegisterFile)
+			}
+			files[meter.RegisterFile] = true
+		}
+		if len(meter.LeakTestFile) > 0 {
+			if files[meter.LeakTestFile] {
+				return fmt.Errorf("meter %v: leak_test_file %v is used by more than one meter", meter.Name, meter.LeakTestFile)
+			}
+			files[meter.LeakTestFile] = true
+		}
+		if len(meter.ShutoffStateFile) > 0 {
+			if files[meter.ShutoffStateFile] {
+				return fmt.Errorf("meter %v: shutoff_state_file %v is used by more than one meter", meter.Name, meter.ShutoffStateFile)
+			}
+			files[meter.ShutoffStateFile] = true
+		}
+		switch meter.InputBackend {
+		case "", BoardInputBackend:
+			if meter.InputPin < 0 {
+				break
+			}
+			if user, ok := pins[meter.InputPin]; ok {
+				return fmt.Errorf("meter %v: input_pin %v is also used by %v", meter.Name, meter.InputPin, user)
+			}
+			pins[meter.InputPin] = "meter " + meter.Name
+		case GPIOInputBackend:
+			line := fmt.Sprintf("%v:%v", meter.GPIOChip, meter.GPIOLine)
+			if user, ok := lines[line]; ok {
+				return fmt.Errorf("meter %v: gpio_line %v on %v is also used by %v", meter.Name, meter.GPIOLine, meter.GPIOChip, user)
+			}
+			lines[line] = "meter " + meter.Name
+		case ReplayInputBackend:
+			if meter.ReplaySpeed <= 0 {
+				meter.ReplaySpeed = 1
+			}
+		}
+		if pin := meter.OutputRelayPin; pin >= 0 {
+			if user, ok := relays[pin]; ok {
+				return fmt.Errorf("meter %v: relay_pin %v is also used by meter %v", meter.Name, pin, user)
+			}
+			relays[pin] = meter.Name
+		}
+		if pin := meter.OutputPin; pin >= 0 {
+			if user, ok := outputs[pin]; ok {
+				return fmt.Errorf("meter %v: output_pin %v is also used by meter %v", meter.Name, pin, user)
+			}
+			outputs[pin] = meter.Name
+		}
+		if err := meter.parse(); err != nil {
+			return fmt.Errorf("meter %v: %v", meter.Name, err)
+		}
+	}
+
+	// Replayed pulses are counted on a simulated clock, shared by all of
+	// the meters, that runs at the replay speed.
+	first := &config.Meters[0]
+	for i := range config.Meters[1:] {
+		meter := &config.Meters[i+1]
+		replay := meter.InputBackend == ReplayInputBackend
+		if replay != (first.InputBackend == ReplayInputBackend) {
+			return fmt.Errorf("meter %v: replayed and live meters cannot be monitored together, see meter %v", meter.Name, first.Name)
+		}
+		if replay && meter.ReplaySpeed != first.ReplaySpeed {
+			return fmt.Errorf("meter %v: replay_speed %v differs from that of meter %v, %v", meter.Name, meter.ReplaySpeed, first.Name, first.ReplaySpeed)
+		}
+	}
+
+	// A shut-off valve's relay must not be driven by any other meter.
+	for i := range config.Meters {
+		meter := &config.Meters[i]
+		if !meter.Shutoff() {
+			continue
+		}
+		for j := range config.Meters {
+			other := &config.Meters[j]
+			if i == j {
+				continue
+			}
+			if other.OutputRelayPin == meter.ShutoffRelayPin {
+				return fmt.Errorf("meter %v: shutoff_relay_pin %v is also used as relay_pin by meter %v", meter.Name, meter.ShutoffRelayPin, other.Name)
+			}
+			if other.Shutoff() && other.ShutoffRelayPin == meter.ShutoffRelayPin {
+				return fmt.Errorf("meter %v: shutoff_relay_pin %v is also used by meter %v", meter.Name, meter.ShutoffRelayPin, other.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (meter *MeterConfig) parse() error {
+	if meter.UnitsPerPulse < 0 {
+		return fmt.Errorf("units_per_pulse %v must not be negative", meter.UnitsPerPulse)
+	}
+	// The legacy alert configuration is only required if no rules are
+	// specified.
+	legacy := len(meter.AlertRules) == 0
+	parseDuration := func(option, value string) (time.Duration, error) {
+		if len(value) == 0 && !legacy {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %v %q as time.Duration: %v", option, value, err)
+		}
+		return d, nil
+	}
+
+	interval, err := parseDuration("alert_interval", meter.AlertInterval)
 	if err != nil {
-		return fmt.Errorf("failed to parse leak_alert_interval %q as time.Duration: %v", config.LeakAlertInterval, err)
+		return err
 	}
 
-	emailAt, err := time.Parse("15:04 -0700", config.StatusEmailTime)
+	idle, err := parseDuration("idle_alert_interval", meter.IdleAlertInterval)
 	if err != nil {
-		return fmt.Errorf("failed to parse %q in 15:04 -0700 format", config.StatusEmailTime)
+		return err
 	}
-	config.DSTAdjustmentDuration, err = time.ParseDuration(config.DSTAdjustment)
+
+	leak, err := parseDuration("leak_alert_interval", meter.LeakAlertInterval)
 	if err != nil {
-		return fmt.Errorf("failed to parse %q as a time.Duration", config.DSTAdjustment)
+		return err
 	}
-	if time.Now().IsDST() {
-		emailAt.Add(config.DSTAdjustmentDuration)
+
+	// The rules are shared with the top-level configuration, copy them
+	// before parsing.
+	if legacy {
+		meter.AlertRules = LegacyAlertRules(meter)
+	} else {
+		meter.AlertRules = append([]AlertRule(nil), meter.AlertRules...)
+	}
+	if len(meter.AwayRules) == 0 {
+		meter.AwayRules = DefaultAwayRules(meter)
+	} else {
+		meter.AwayRules = append([]AlertRule(nil), meter.AwayRules...)
+	}
+	names := map[string]bool{}
+	for _, rule := range meter.AllRules() {
+		if err := rule.parse(); err != nil {
+			return err
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate rule name: %v", rule.Name)
+		}
+		if (rule.Type == BaselineRule || rule.Type == LostPulsesRule) && meter.BaselineWeeks <= 0 {
+			return fmt.Errorf("rule %v: baseline_weeks is required for %v", rule.Name, rule.Type)
+		}
+		names[rule.Name] = true
 	}
 
-	config.StatusTime = emailAt
-	config.AlertDuration = interval
-	config.IdleAlertDuration = idle
-	config.LeakAlertDuration = leak
+	if meter.Shutoff() {
+		if meter.ShutoffRelayPin < 0 {
+			return fmt.Errorf("shutoff_relay_pin is required by rules with shutoff set")
+		}
+		if meter.ShutoffRelayPin == meter.OutputRelayPin {
+			return fmt.Errorf("shutoff_relay_pin %v is also used as relay_pin", meter.ShutoffRelayPin)
+		}
+		meter.ShutoffActuationDuration = DefaultShutoffActuationPeriod
+		if len(meter.ShutoffActuationPeriod) > 0 {
+			if meter.ShutoffActuationDuration, err = time.ParseDuration(meter.ShutoffActuationPeriod); err != nil {
+				return fmt.Errorf("failed to parse shutoff_actuation_period %q as time.Duration: %v", meter.ShutoffActuationPeriod, err)
+			}
+		}
+	}
+
+	meter.LeakTestDefaultDuration = DefaultLeakTestDuration
+	if len(meter.LeakTestDuration) > 0 {
+		if meter.LeakTestDefaultDuration, err = time.ParseDuration(meter.LeakTestDuration); err != nil {
+			return fmt.Errorf("failed to parse leak_test_duration %q as time.Duration: %v", meter.LeakTestDuration, err)
+		}
+		if meter.LeakTestDefaultDuration <= 0 {
+			return fmt.Errorf("leak_test_duration %v must be positive", meter.LeakTestDuration)
+		}
+	}
+
+	if len(meter.InitialRegisterTime) > 0 {
+		if _, err := time.Parse(time.RFC3339, meter.InitialRegisterTime); err != nil {
+			return fmt.Errorf("failed to parse initial_register_time %q in RFC3339 format: %v", meter.InitialRegisterTime, err)
+		}
+	}
+
+	meter.AlertDuration = interval
+	meter.IdleAlertDuration = idle
+	meter.LeakAlertDuration = leak
 	return nil
 }
 
+// InitialRegisterAnchor returns the RegisterAnchor for the configured
+// initial register reading.
+func (meter *MeterConfig) InitialRegisterAnchor() (*RegisterAnchor, error) {
+	at := time.Now()
+	if len(meter.InitialRegisterTime) > 0 {
+		var err error
+		if at, err = time.Parse(time.RFC3339, meter.InitialRegisterTime); err != nil {
+			return nil, err
+		}
+	}
+	return NewRegisterAnchor(meter.PulseTimestampFile, meter.InitialRegister, at)
+}
+
+// AllRules returns pointers to all of the meter's alert and away rules.
+func (meter *MeterConfig) AllRules() []*AlertRule {
+	rules := make([]*AlertRule, 0, len(meter.AlertRules)+len(meter.AwayRules))
+	for i := range meter.AlertRules {
+		rules = append(rules, &meter.AlertRules[i])
+	}
+	for i := range meter.AwayRules {
+		rules = append(rules, &meter.AwayRules[i])
+	}
+	return rules
+}
+
+// Shutoff returns true if any of the meter's alert or away rules close
+// its shut-off valve.
+func (meter *MeterConfig) Shutoff() bool {
+	for _, rule := range meter.AllRules() {
+		if rule.Shutoff {
+			return true
+		}
+	}
+	return false
+}
+
+// MinPulseInterval returns the minimum possible interval between pulses
+// given the meter's maximum flow rate.
+func (meter *MeterConfig) MinPulseInterval() time.Duration {
+	if meter.MaxFlowRate <= 0 {
+		return 0
+	}
+	return time.Duration(meter.UnitsPerPulse / meter.MaxFlowRate * float64(time.Minute))
+}
+
+// Volume returns the volume, in the meter's units, represented by the
+// specified number of pulses. It is rounded to a thousandth of a unit to
+// hide the rounding errors introduced by fractional units per pulse.
+func (meter *MeterConfig) Volume(pulses int64) float64 {
+	return math.Round(float64(pulses)*meter.UnitsPerPulse*1000) / 1000
+}
+
+// FormatVolume formats a volume without an exponent or trailing zeros,
+// eg. 1000000 or 0.5.
+func FormatVolume(volume float64) string {
+	return strconv.FormatFloat(volume, 'f', -1, 64)
+}
+
+// Meter returns the configuration for the named meter.
+func (config *Configuration) Meter(name string) (*MeterConfig, error) {
+	for i := range config.Meters {
+		if config.Meters[i].Name == name {
+			return &config.Meters[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no such meter: %q", name)
+}
+
 type SMTPClient struct {
 	to                          []string
 	host, domain, from          string
@@ -151,7 +596,7 @@ func (config *Configuration) ConfigureEmail(sendHello bool) (*SMTPClient, error)
 	if err != nil {
 		return nil, err
 	}
-	dailyIn := UntilHHMM(config.StatusTime)
+	dailyIn := UntilHHMMDST(time.Now(), config.StatusTime, config.DSTAdjustmentDuration)
 	client.port = port
 	err = client.Status("", fmt.Sprintf("%v started on %v @ %v (next daily email for %v, %v UTC in %v)\n", os.Args[0], hostname, time.Now(), HHMM(config.StatusTime), HHMM(config.StatusTime.UTC()), dailyIn))
 	if err != nil {
@@ -161,13 +606,19 @@ func (config *Configuration) ConfigureEmail(sendHello bool) (*SMTPClient, error)
 	return client, nil
 }
 
-// Alert sends an alert email.
+// Alert sends an alert email, it does nothing if sc is nil.
 func (sc *SMTPClient) Alert(body string) error {
+	if sc == nil {
+		return nil
+	}
 	return sc.Send(sc.alertSubject, body)
 }
 
-// Status sends a status email.
+// Status sends a status email, it does nothing if sc is nil.
 func (sc *SMTPClient) Status(trailer, body string) error {
+	if sc == nil {
+		return nil
+	}
 	return sc.Send(sc.statusSubject+trailer, body)
 }
 
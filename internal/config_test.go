@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readConfig writes the JSON configuration, cfg, to a temporary file,
+// with the options required by ReadConfig, and reads it.
+func readConfig(t *testing.T, cfg string) (*Configuration, error) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pulsemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	defaults := `"status_email_time": "07:00 -0700", "daylight_savings_adjustment": "1h",
+"alert_interval": "1m", "idle_alert_interval": "10m", "leak_alert_interval": "1h", "alert_pulses": 100,
+"gallons_per_pulse": 10, "input_pin": -1, "relay_pin": -1, "output_pin": -1`
+	if err := ioutil.WriteFile(filename, []byte("{"+defaults+", "+cfg+"}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var config Configuration
+	return &config, ReadConfig(filename, &config)
+}
+
+func TestReadConfigMeterErrors(t *testing.T) {
+	for i, tc := range []struct {
+		meters string
+		err    string
+	}{
+		{`{"name": "a", "pulse_timestamps_file": "a.ts", "input_pin": 1, "relay_pin": 0},
+{"name": "b", "pulse_timestamps_file": "b.ts", "input_pin": 2, "relay_pin": 0}`,
+			"meter b: relay_pin 0 is also used by meter a"},
+		{`{"name": "a", "pulse_timestamps_file": "a.ts", "input_pin": 1, "output_pin": 3},
+{"name": "b", "pulse_timestamps_file": "b.ts", "input_pin": 2, "output_pin": 3}`,
+			"meter b: output_pin 3 is also used by meter a"},
+		{`{"name": "a", "pulse_timestamps_file": "a.ts", "input_backend": "replay", "replay_file": "r.ts"},
+{"name": "b", "pulse_timestamps_file": "b.ts", "input_pin": 1}`,
+			"meter b: replayed and live meters cannot be monitored together"},
+		{`{"name": "a", "pulse_timestamps_file": "a.ts", "input_pin": 1},
+{"name": "b", "pulse_timestamps_file": "b.ts", "input_backend": "replay", "replay_file": "r.ts"}`,
+			"meter b: replayed and live meters cannot be monitored together"},
+		{`{"name": "a", "pulse_timestamps_file": "a.ts", "input_backend": "replay", "replay_file": "r.ts", "replay_speed": 60},
+{"name": "b", "pulse_timestamps_file": "b.ts", "input_backend": "replay", "replay_file": "r.ts"}`,
+			"meter b: replay_speed 1 differs from that of meter a, 60"},
+	} {
+		_, err := readConfig(t, `"meters": [`+tc.meters+`]`)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: got %v, want an error containing %q", i, err, tc.err)
+		}
+	}
+
+	// Forwarding pins are inherited from the top-level configuration.
+	_, err := readConfig(t, `"relay_pin": 1, "meters": [
+{"name": "a", "pulse_timestamps_file": "a.ts", "input_pin": 1},
+{"name": "b", "pulse_timestamps_file": "b.ts", "input_pin": 2}]`)
+	if err == nil || !strings.Contains(err.Error(), "meter b: relay_pin 1 is also used by meter a") {
+		t.Errorf("got %v, want an error for the inherited relay_pin", err)
+	}
+	if _, err := readConfig(t, `"relay_pin": 1, "output_pin": 2, "meters": [
+{"name": "a", "pulse_timestamps_file": "a.ts", "input_pin": 1},
+{"name": "b", "pulse_timestamps_file": "b.ts", "input_pin": 2, "relay_pin": -1, "output_pin": -1}]`); err != nil {
+		t.Error(err)
+	}
+
+	config, err := readConfig(t, `"meters": [
+{"name": "a", "pulse_timestamps_file": "a.ts", "input_backend": "replay", "replay_file": "r.ts"},
+{"name": "b", "pulse_timestamps_file": "b.ts", "input_backend": "replay", "replay_file": "r.ts", "replay_speed": 1}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.Meters[0].ReplaySpeed, 1.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+// Supported values for the debounce configuration option.
+const (
+	// CounterDebounce accepts a pulse once the input has been continuously
+	// closed for the debounce duration, any shorter closure is a glitch.
+	// Closures are not accumulated across bounces and, when polled, the
+	// sample at the end of the debounce duration is required.
+	CounterDebounce = "counter"
+	// IntegratorDebounce integrates the input, rising whilst it is closed
+	// and falling whilst it is open, accepting a pulse when the integrator
+	// reaches the debounce duration and ending it when it falls back to
+	// zero. This provides hysteresis and tolerates bounces that would
+	// reset the counter.
+	IntegratorDebounce = "integrator"
+	// MinIntervalDebounce accepts a pulse on the first closure and then
+	// rejects any closures that occur within the minimum interval
+	// implied by the meter's maximum physical flow rate.
+	MinIntervalDebounce = "min-interval"
+)
+
+// DebounceEventType identifies the outcome of a call to Debouncer.Update.
+type DebounceEventType int
+
+// Possible values of DebounceEventType.
+const (
+	NoDebounceEvent DebounceEventType = iota
+	// PulseStarted indicates that a pulse has been accepted.
+	PulseStarted
+	// PulseEnded indicates that a previously accepted pulse has ended.
+	PulseEnded
+	// GlitchRejected indicates that a closure was rejected as a glitch.
+	GlitchRejected
+)
+
+// DebounceEvent is returned by Debouncer.Update.
+type DebounceEvent struct {
+	Type DebounceEventType
+	// Rising is the time of the first closed observation of the pulse
+	// or glitch.
+	Rising time.Time
+	// Uncertainty is the time between Rising and the observation that
+	// preceded it, ie. the circuit closed at some point in that interval.
+	Uncertainty time.Duration
+	// Falling is the time at which a pulse ended, it is only set for
+	// PulseEnded.
+	Falling time.Time
+}
+
+// Debouncer applies a debounce algorithm to a stream of timestamped
+// observations of an input, these may be either polled samples or edge
+// events.
+type Debouncer struct {
+	alg   debounceAlgorithm
+	last  time.Time
+	value byte
+}
+
+type debounceAlgorithm interface {
+	// update is called with each observation, it is guaranteed to be
+	// called at any deadline that has passed before a later observation.
+	update(when time.Time, value byte) DebounceEvent
+	// deadline returns the time at which update should next be called,
+	// with an unchanged value, or the zero time if no call is needed.
+	deadline() time.Time
+}
+
+// NewDebouncer creates the Debouncer specified by meter.Debounce, it
+// defaults to CounterDebounce.
+func NewDebouncer(meter *MeterConfig) (*Debouncer, error) {
+	debounce := time.Duration(meter.InputDebounceMS) * time.Millisecond
+	switch meter.Debounce {
+	case "", CounterDebounce:
+		return &Debouncer{alg: &counterDebouncer{debounce: debounce}}, nil
+	case IntegratorDebounce:
+		return &Debouncer{alg: &integratorDebouncer{threshold: debounce}}, nil
+	case MinIntervalDebounce:
+		if meter.MaxFlowRate <= 0 {
+			return nil, fmt.Errorf("%v debounce requires a max_flow_rate", MinIntervalDebounce)
+		}
+		return &Debouncer{alg: &minIntervalDebouncer{interval: meter.MinPulseInterval()}}, nil
+	}
+	return nil, fmt.Errorf("unsupported debounce: %q", meter.Debounce)
+}
+
+// Update informs the Debouncer of the value of the input at the specified
+// time and returns any resulting events. Observations that appear to be
+// earlier than the previous one, eg. an edge event delivered after a
+// timer for a Deadline, are treated as occurring at the same time.
+func (d *Debouncer) Update(when time.Time, value byte) []DebounceEvent {
+	if when.Before(d.last) {
+		when = d.last
+	}
+	var events []DebounceEvent
+	for dl := d.alg.deadline(); !dl.IsZero() && !dl.After(when); dl = d.alg.deadline() {
+		ev := d.alg.update(dl, d.value)
+		if ev.Type != NoDebounceEvent {
+			events = append(events, ev)
+		}
+		if !d.alg.deadline().After(dl) {
+			break
+		}
+	}
+	d.last, d.value = when, value
+	if ev := d.alg.update(when, value); ev.Type != NoDebounceEvent {
+		events = append(events, ev)
+	}
+	return events
+}
+
+// Deadline returns the time at which Update should be called again,
+// with an unchanged value, if no other observation is made before then.
+// It returns the zero time if no such call is needed.
+func (d *Debouncer) Deadline() time.Time {
+	return d.alg.deadline()
+}
+
+// Value returns the most recently observed value.
+func (d *Debouncer) Value() byte {
+	return d.value
+}
+
+type counterDebouncer struct {
+	debounce        time.Duration
+	last            time.Time
+	closed, counted bool
+	rising          time.Time
+	uncertainty     time.Duration
+}
+
+func (cd *counterDebouncer) update(when time.Time, value byte) DebounceEvent {
+	prev := cd.last
+	cd.last = when
+	if value == 0 {
+		var ev DebounceEvent
+		switch {
+		case cd.counted:
+			ev = DebounceEvent{Type: PulseEnded, Rising: cd.rising, Uncertainty: cd.uncertainty, Falling: when}
+		case cd.closed:
+			ev = DebounceEvent{Type: GlitchRejected, Rising: cd.rising, Uncertainty: cd.uncertainty}
+		}
+		cd.closed, cd.counted = false, false
+		return ev
+	}
+	if !cd.closed {
+		cd.closed = true
+		cd.rising = when
+		cd.uncertainty = sinceLast(prev, when)
+	}
+	if !cd.counted && when.Sub(cd.rising) >= cd.debounce {
+		cd.counted = true
+		return DebounceEvent{Type: PulseStarted, Rising: cd.rising, Uncertainty: cd.uncertainty}
+	}
+	return DebounceEvent{}
+}
+
+func (cd *counterDebouncer) deadline() time.Time {
+	if cd.closed && !cd.counted {
+		return cd.rising.Add(cd.debounce)
+	}
+	return time.Time{}
+}
+
+type integratorDebouncer struct {
+	threshold       time.Duration
+	level           time.Duration
+	last            time.Time
+	value           byte
+	active, counted bool
+	rising, falling time.Time
+	uncertainty     time.Duration
+}
+
+func (id *integratorDebouncer) update(when time.Time, value byte) DebounceEvent {
+	prev := id.last
+	if !prev.IsZero() {
+		// Integrate the previous value over the time since it was observed.
+		if elapsed := when.Sub(prev); id.value == 1 {
+			id.level += elapsed
+			if id.level > id.threshold {
+				id.level = id.threshold
+			}
+		} else {
+			id.level -= elapsed
+			if id.level < 0 {
+				id.level = 0
+			}
+		}
+	}
+	id.last = when
+	if id.value == 1 && value == 0 {
+		id.falling = when
+	}
+	id.value = value
+
+	var ev DebounceEvent
+	switch {
+	case id.active && !id.counted && id.level >= id.threshold:
+		id.counted = true
+		ev = DebounceEvent{Type: PulseStarted, Rising: id.rising, Uncertainty: id.uncertainty}
+	case id.active && id.level == 0 && value == 0:
+		ev = DebounceEvent{Type: GlitchRejected, Rising: id.rising, Uncertainty: id.uncertainty}
+		if id.counted {
+			ev.Type = PulseEnded
+			ev.Falling = id.falling
+		}
+		id.active, id.counted = false, false
+	}
+	if value == 1 && !id.active {
+		id.active = true
+		id.rising = when
+		id.uncertainty = sinceLast(prev, when)
+		if id.threshold == 0 {
+			id.counted = true
+			ev = DebounceEvent{Type: PulseStarted, Rising: id.rising, Uncertainty: id.uncertainty}
+		}
+	}
+	return ev
+}
+
+func (id *integratorDebouncer) deadline() time.Time {
+	switch {
+	case !id.active:
+		return time.Time{}
+	case id.value == 1 && !id.counted:
+		return id.last.Add(id.threshold - id.level)
+	case id.value == 0:
+		return id.last.Add(id.level)
+	}
+	return time.Time{}
+}
+
+type minIntervalDebouncer struct {
+	interval        time.Duration
+	last            time.Time
+	value           byte
+	counted, ending bool
+	rising, falling time.Time
+	uncertainty     time.Duration
+}
+
+func (md *minIntervalDebouncer) update(when time.Time, value byte) DebounceEvent {
+	prev := md.last
+	md.last = when
+	changed := value != md.value
+	md.value = value
+	lockout := md.counted && when.Sub(md.rising) < md.interval
+	if value == 0 {
+		if changed && md.counted {
+			md.falling = when
+			md.ending = true
+		}
+		if md.ending && !lockout {
+			// The pulse is only considered to have ended once the input
+			// has remained open until the end of the lockout period,
+			// any closures before then are bounces.
+			md.ending, md.counted = false, false
+			return DebounceEvent{Type: PulseEnded, Rising: md.rising, Uncertainty: md.uncertainty, Falling: md.falling}
+		}
+		return DebounceEvent{}
+	}
+	if !changed {
+		return DebounceEvent{}
+	}
+	if lockout {
+		md.ending = false
+		return DebounceEvent{Type: GlitchRejected, Rising: when, Uncertainty: sinceLast(prev, when)}
+	}
+	md.counted = true
+	md.rising = when
+	md.uncertainty = sinceLast(prev, when)
+	return DebounceEvent{Type: PulseStarted, Rising: md.rising, Uncertainty: md.uncertainty}
+}
+
+func (md *minIntervalDebouncer) deadline() time.Time {
+	if md.ending {
+		return md.rising.Add(md.interval)
+	}
+	return time.Time{}
+}
+
+func sinceLast(prev, when time.Time) time.Duration {
+	if prev.IsZero() {
+		return 0
+	}
+	return when.Sub(prev)
+}
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+// observation is the value of an input at a time, in milliseconds.
+type observation struct {
+	at    int
+	value byte
+}
+
+// debounceEvent is a DebounceEvent with times, in milliseconds, relative
+// to the first observation.
+type debounceEvent struct {
+	typ                          DebounceEventType
+	rising, uncertainty, falling int
+}
+
+var debounceStart = time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+// runDebouncer applies the observations to a Debouncer. If polled is
+// false the observations are treated as edge events and, as for the
+// monitor, Update is also called at every Deadline.
+func runDebouncer(t *testing.T, d *Debouncer, observations []observation, polled bool) []debounceEvent {
+	t.Helper()
+	var events []DebounceEvent
+	deadlines := func(before time.Time) {
+		for dl := d.Deadline(); !polled && !dl.IsZero() && dl.Before(before); dl = d.Deadline() {
+			events = append(events, d.Update(dl, d.Value())...)
+		}
+	}
+	for _, o := range observations {
+		when := debounceStart.Add(ms(o.at))
+		deadlines(when)
+		events = append(events, d.Update(when, o.value)...)
+	}
+	deadlines(debounceStart.Add(time.Hour))
+	var got []debounceEvent
+	for _, ev := range events {
+		e := debounceEvent{
+			typ:         ev.Type,
+			rising:      int(ev.Rising.Sub(debounceStart) / time.Millisecond),
+			uncertainty: int(ev.Uncertainty / time.Millisecond),
+		}
+		if ev.Type == PulseEnded {
+			e.falling = int(ev.Falling.Sub(debounceStart) / time.Millisecond)
+		}
+		got = append(got, e)
+	}
+	return got
+}
+
+// samples returns observations at the specified interval from 0 to end,
+// the input is closed between each pair of times in closed.
+func samples(interval, end int, closed ...int) []observation {
+	var obs []observation
+	for at := 0; at <= end; at += interval {
+		value := byte(0)
+		for i := 0; i+1 < len(closed); i += 2 {
+			if at >= closed[i] && at < closed[i+1] {
+				value = 1
+			}
+		}
+		obs = append(obs, observation{at, value})
+	}
+	return obs
+}
+
+func TestDebounce(t *testing.T) {
+	counter := &MeterConfig{InputDebounceMS: 50}
+	integrator := &MeterConfig{Debounce: IntegratorDebounce, InputDebounceMS: 50}
+	// 600 units/min at 1 unit per pulse is a minimum interval of 100ms.
+	minInterval := &MeterConfig{Debounce: MinIntervalDebounce, UnitsPerPulse: 1, MaxFlowRate: 600}
+
+	for i, tc := range []struct {
+		name         string
+		config       *MeterConfig
+		polled       bool
+		observations []observation
+		events       []debounceEvent
+	}{
+		{"counter: bounces shorter than the debounce", counter, false,
+			[]observation{{0, 1}, {10, 0}, {20, 1}, {30, 0}, {100, 1}, {300, 0}},
+			[]debounceEvent{
+				{GlitchRejected, 0, 0, 0},
+				{GlitchRejected, 20, 10, 0},
+				{PulseStarted, 100, 70, 0},
+				{PulseEnded, 100, 70, 300},
+			}},
+		{"counter: long closure", counter, false,
+			[]observation{{0, 0}, {10, 1}, {60000, 0}},
+			[]debounceEvent{
+				{PulseStarted, 10, 10, 0},
+				{PulseEnded, 10, 10, 60000},
+			}},
+		{"counter: glitch", counter, false,
+			[]observation{{0, 0}, {100, 1}, {149, 0}},
+			[]debounceEvent{
+				{GlitchRejected, 100, 100, 0},
+			}},
+		{"counter: closed for exactly the debounce", counter, false,
+			[]observation{{0, 0}, {100, 1}, {150, 0}},
+			[]debounceEvent{
+				{PulseStarted, 100, 100, 0},
+				{PulseEnded, 100, 100, 150},
+			}},
+		{"counter: polled uncertainty", counter, true,
+			samples(10, 300, 45, 200),
+			[]debounceEvent{
+				// Closed at some point between the samples at 40 and 50.
+				{PulseStarted, 50, 10, 0},
+				{PulseEnded, 50, 10, 200},
+			}},
+		{"counter: polled bounce then closure", counter, true,
+			samples(10, 300, 0, 20, 40, 200),
+			[]debounceEvent{
+				// The pulse must start at the second closure, not at the
+				// first closure that was rejected as a bounce.
+				{GlitchRejected, 0, 0, 0},
+				{PulseStarted, 40, 10, 0},
+				{PulseEnded, 40, 10, 200},
+			}},
+		{"counter: polled bounces reopening before the debounce", counter, true,
+			samples(10, 300, 0, 30, 40, 70, 80, 150),
+			[]debounceEvent{
+				{GlitchRejected, 0, 0, 0},
+				{GlitchRejected, 40, 10, 0},
+				{PulseStarted, 80, 10, 0},
+				{PulseEnded, 80, 10, 150},
+			}},
+		{"integrator: bounces shorter than the debounce", integrator, false,
+			[]observation{{0, 1}, {30, 0}, {35, 1}, {200, 0}},
+			[]debounceEvent{
+				// The integrator reaches 25ms at 35ms and 50ms at 60ms.
+				{PulseStarted, 0, 0, 0},
+				{PulseEnded, 0, 0, 200},
+			}},
+		{"integrator: bounce on release", integrator, false,
+			[]observation{{0, 1}, {200, 0}, {210, 1}, {220, 0}},
+			[]debounceEvent{
+				{PulseStarted, 0, 0, 0},
+				{PulseEnded, 0, 0, 220},
+			}},
+		{"integrator: long closure", integrator, false,
+			[]observation{{0, 0}, {10, 1}, {60000, 0}},
+			[]debounceEvent{
+				{PulseStarted, 10, 10, 0},
+				{PulseEnded, 10, 10, 60000},
+			}},
+		{"integrator: glitch", integrator, false,
+			[]observation{{0, 0}, {100, 1}, {120, 0}, {125, 1}, {130, 0}},
+			[]debounceEvent{
+				{GlitchRejected, 100, 100, 0},
+			}},
+		{"integrator: polled uncertainty", integrator, true,
+			samples(10, 300, 45, 200),
+			[]debounceEvent{
+				{PulseStarted, 50, 10, 0},
+				{PulseEnded, 50, 10, 200},
+			}},
+		{"min-interval: bounces within the interval", minInterval, false,
+			[]observation{{0, 1}, {5, 0}, {10, 1}, {20, 0}, {150, 1}, {160, 0}},
+			[]debounceEvent{
+				{PulseStarted, 0, 0, 0},
+				{GlitchRejected, 10, 5, 0},
+				// The pulse ends at the end of the interval.
+				{PulseEnded, 0, 0, 20},
+				{PulseStarted, 150, 50, 0},
+				{PulseEnded, 150, 50, 160},
+			}},
+		{"min-interval: long closure", minInterval, false,
+			[]observation{{0, 0}, {10, 1}, {60000, 0}},
+			[]debounceEvent{
+				{PulseStarted, 10, 10, 0},
+				{PulseEnded, 10, 10, 60000},
+			}},
+		{"min-interval: polled uncertainty", minInterval, true,
+			samples(10, 300, 45, 60, 70, 80, 200, 250),
+			[]debounceEvent{
+				{PulseStarted, 50, 10, 0},
+				{GlitchRejected, 70, 10, 0},
+				{PulseEnded, 50, 10, 80},
+				{PulseStarted, 200, 10, 0},
+				{PulseEnded, 200, 10, 250},
+			}},
+	} {
+		d, err := NewDebouncer(tc.config)
+		if err != nil {
+			t.Fatalf("%v: %v: %v", i, tc.name, err)
+		}
+		got := runDebouncer(t, d, tc.observations, tc.polled)
+		if len(got) != len(tc.events) {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.name, got, tc.events)
+			continue
+		}
+		for j := range got {
+			if got[j] != tc.events[j] {
+				t.Errorf("%v: %v: event %v: got %+v, want %+v", i, tc.name, j, got[j], tc.events[j])
+			}
+		}
+	}
+}
+
+func TestDebounceOutOfOrder(t *testing.T) {
+	d, err := NewDebouncer(&MeterConfig{InputDebounceMS: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An observation that appears to be earlier than the previous one is
+	// treated as occurring at the same time.
+	got := runDebouncer(t, d, []observation{{0, 1}, {50, 1}, {40, 0}}, true)
+	want := []debounceEvent{
+		{PulseStarted, 0, 0, 0},
+		{PulseEnded, 0, 0, 50},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNewDebouncer(t *testing.T) {
+	for _, cfg := range []*MeterConfig{
+		{Debounce: "unknown"},
+		{Debounce: MinIntervalDebounce},
+	} {
+		if _, err := NewDebouncer(cfg); err == nil {
+			t.Errorf("%q: expected an error", cfg.Debounce)
+		}
+	}
+}
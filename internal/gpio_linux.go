@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Definitions from the Linux GPIO character device (v1) ABI, see
+// include/uapi/linux/gpio.h.
+const (
+	gpioGetLineEventIOCTL        = 0xc030b404
+	gpioHandleGetLineValuesIOCTL = 0xc040b408
+
+	gpioHandleRequestInput        = 1 << 0
+	gpioHandleRequestActiveLow    = 1 << 2
+	gpioHandleRequestBiasPullUp   = 1 << 5
+	gpioHandleRequestBiasPullDown = 1 << 6
+	gpioHandleRequestBiasDisable  = 1 << 7
+
+	gpioEventRequestBothEdges = 0x03
+
+	gpioEventRisingEdge = 0x01
+
+	clockMonotonic = 1
+)
+
+type gpioEventRequest struct {
+	lineOffset    uint32
+	handleFlags   uint32
+	eventFlags    uint32
+	consumerLabel [32]byte
+	fd            int32
+}
+
+type gpioHandleData struct {
+	values [64]uint8
+}
+
+type gpioEventData struct {
+	timestamp uint64
+	id        uint32
+	_         uint32
+}
+
+// GPIOInput is an implementation of DigitalInput that uses the Linux
+// GPIO character device to read a single line, such as a Raspberry Pi
+// header pin. The line is requested with edge events enabled.
+type GPIOInput struct {
+	chip   string
+	line   int
+	file   *os.File
+	once   sync.Once
+	edges  chan Edge
+	closed sync.Once
+	done   chan struct{}
+}
+
+var gpioBiasFlags = map[string]uint32{
+	"":          0,
+	"as-is":     0,
+	"pull-up":   gpioHandleRequestBiasPullUp,
+	"pull-down": gpioHandleRequestBiasPullDown,
+	"disable":   gpioHandleRequestBiasDisable,
+}
+
+func gpioChipPath(chip string) string {
+	if len(chip) == 0 {
+		chip = "gpiochip0"
+	}
+	if !strings.HasPrefix(chip, "/") {
+		chip = "/dev/" + chip
+	}
+	return chip
+}
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// NewGPIOInput requests the specified line on the specified gpio chip,
+// (eg. gpiochip0 or /dev/gpiochip0) with the specified bias (one of
+// pull-up, pull-down, disable or as-is). If activeLow is true then the
+// line is treated as being active (closed) when it reads low, as is the
+// case for a reed switch connected to ground with a pull-up resistor.
+func NewGPIOInput(chip string, line int, bias string, activeLow bool) (*GPIOInput, error) {
+	biasFlags, ok := gpioBiasFlags[bias]
+	if !ok {
+		return nil, fmt.Errorf("unsupported gpio bias: %q", bias)
+	}
+	path := gpioChipPath(chip)
+	cf, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %v", path, err)
+	}
+	defer cf.Close()
+	req := gpioEventRequest{
+		lineOffset:  uint32(line),
+		handleFlags: gpioHandleRequestInput | biasFlags,
+		eventFlags:  gpioEventRequestBothEdges,
+	}
+	if activeLow {
+		req.handleFlags |= gpioHandleRequestActiveLow
+	}
+	copy(req.consumerLabel[:len(req.consumerLabel)-1], "pulsemon")
+	if err := ioctl(cf.Fd(), gpioGetLineEventIOCTL, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("failed to request line %v on %v: %v", line, path, err)
+	}
+	// A non-blocking descriptor is managed by the runtime poller which
+	// allows Close to interrupt a pending read.
+	if err := syscall.SetNonblock(int(req.fd), true); err != nil {
+		syscall.Close(int(req.fd))
+		return nil, fmt.Errorf("failed to configure line %v on %v: %v", line, path, err)
+	}
+	return &GPIOInput{
+		chip: path,
+		line: line,
+		file: os.NewFile(uintptr(req.fd), fmt.Sprintf("%v:%v", path, line)),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// Value implements DigitalInput. It returns 0 if the line cannot be read.
+func (gi *GPIOInput) Value() byte {
+	var data gpioHandleData
+	if err := ioctl(gi.file.Fd(), gpioHandleGetLineValuesIOCTL, unsafe.Pointer(&data)); err != nil {
+		return 0
+	}
+	return data.values[0]
+}
+
+// Edges implements EdgeSource.
+func (gi *GPIOInput) Edges() <-chan Edge {
+	gi.once.Do(func() {
+		gi.edges = make(chan Edge, 64)
+		go gi.readEvents()
+	})
+	return gi.edges
+}
+
+func (gi *GPIOInput) readEvents() {
+	defer close(gi.edges)
+	buf := make([]byte, unsafe.Sizeof(gpioEventData{}))
+	for {
+		if _, err := io.ReadFull(gi.file, buf); err != nil {
+			return
+		}
+		ev := (*gpioEventData)(unsafe.Pointer(&buf[0]))
+		edge := Edge{Time: gpioEventTime(ev.timestamp)}
+		if ev.id == gpioEventRisingEdge {
+			edge.Value = 1
+		}
+		select {
+		case gi.edges <- edge:
+		case <-gi.done:
+			return
+		}
+	}
+}
+
+// gpioEventTime converts a kernel event timestamp to a time.Time. Kernels
+// prior to 5.7 use CLOCK_REALTIME for event timestamps and later ones use
+// CLOCK_MONOTONIC.
+func gpioEventTime(ts uint64) time.Time {
+	now := time.Now()
+	if d := time.Duration(now.UnixNano() - int64(ts)); d > -time.Hour && d < time.Hour {
+		return time.Unix(0, int64(ts))
+	}
+	var mono syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&mono)), 0); errno != 0 {
+		return now
+	}
+	return now.Add(-time.Duration(mono.Nano() - int64(ts)))
+}
+
+// Close releases the requested line, it interrupts any pending read
+// and stops the delivery of edges.
+func (gi *GPIOInput) Close() error {
+	gi.closed.Do(func() { close(gi.done) })
+	return gi.file.Close()
+}
+
+func (gi *GPIOInput) String() string {
+	return fmt.Sprintf("%v line %v", gi.chip, gi.line)
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package internal
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// GPIOInput is only supported on Linux.
+type GPIOInput struct{}
+
+// NewGPIOInput always returns an error on non-Linux systems.
+func NewGPIOInput(chip string, line int, bias string, activeLow bool) (*GPIOInput, error) {
+	return nil, fmt.Errorf("gpio character device input is not supported on %v", runtime.GOOS)
+}
+
+// Value implements DigitalInput.
+func (gi *GPIOInput) Value() byte {
+	return 0
+}
+
+// Edges implements EdgeSource.
+func (gi *GPIOInput) Edges() <-chan Edge {
+	ch := make(chan Edge)
+	close(ch)
+	return ch
+}
+
+// Close releases the requested line.
+func (gi *GPIOInput) Close() error {
+	return nil
+}
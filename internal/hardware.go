@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+// DigitalInput represents a single digital input such as the pin that a
+// reed switch is connected to.
+type DigitalInput interface {
+	// Value returns 1 if the input is closed (active) and 0 otherwise.
+	Value() byte
+}
+
+// Edge represents a timestamped transition on a digital input.
+type Edge struct {
+	// Time is the time at which the transition occurred.
+	Time time.Time
+	// Value is the value of the input after the transition, 1 for a rising
+	// edge (closed) and 0 for a falling edge (open).
+	Value byte
+}
+
+// EdgeSource is implemented by DigitalInputs that can deliver timestamped
+// edge events rather than having to be polled.
+type EdgeSource interface {
+	// Edges returns a channel on which edge events are delivered, the
+	// channel is closed when the input is closed or can no longer be read.
+	Edges() <-chan Edge
+}
+
+// DigitalOutput represents a single digital output such as a relay or
+// a cmos/open-collector output pin.
+type DigitalOutput interface {
+	On()
+	Off()
+}
+
+// LEDBank represents a bank of LEDs used to display status information.
+type LEDBank interface {
+	// Len returns the number of LEDs in the bank.
+	Len() int
+	// Set sets the specified LED on (1) or off (0).
+	Set(led int, value byte)
+}
+
+// Board represents the I/O hardware used by pulsemon.
+type Board interface {
+	Input(pin int) (DigitalInput, error)
+	Relay(pin int) (DigitalOutput, error)
+	Output(pin int) (DigitalOutput, error)
+	LEDs() LEDBank
+	Close() error
+}
+
+// Supported values for the hardware configuration option.
+const (
+	PiFaceHardware    = "piface"
+	SimulatedHardware = "simulated"
+	NoHardware        = "none"
+)
+
+// Supported values for the input_backend configuration option.
+const (
+	BoardInputBackend  = "board"
+	GPIOInputBackend   = "gpio"
+	ReplayInputBackend = "replay"
+)
+
+// NewBoard creates and initializes the Board specified by config.Hardware,
+// it defaults to a PiFace board if none is specified.
+func NewBoard(config *Configuration) (Board, error) {
+	switch config.Hardware {
+	case "", PiFaceHardware:
+		return NewPiFaceBoard()
+	case SimulatedHardware:
+		return NewSimulatedBoard(config.SimulatedInput, config.SimulatedRepeat), nil
+	case NoHardware:
+		return noBoard{}, nil
+	}
+	return nil, fmt.Errorf("unsupported hardware: %q", config.Hardware)
+}
+
+// NewInput returns the DigitalInput specified by meter.InputBackend,
+// it defaults to meter.InputPin on the supplied board.
+func NewInput(meter *MeterConfig, board Board) (DigitalInput, error) {
+	switch meter.InputBackend {
+	case "", BoardInputBackend:
+		return board.Input(meter.InputPin)
+	case GPIOInputBackend:
+		return NewGPIOInput(meter.GPIOChip, meter.GPIOLine, meter.GPIOBias, meter.GPIOActiveLow)
+	}
+	return nil, fmt.Errorf("unsupported input backend: %q", meter.InputBackend)
+}
+
+// noBoard is used when there is no I/O board, eg. when the input is
+// read directly from a GPIO header pin.
+type noBoard struct{}
+
+func (noBoard) Input(pin int) (DigitalInput, error) {
+	return nil, fmt.Errorf("no hardware configured for input pin %v", pin)
+}
+
+func (noBoard) Relay(pin int) (DigitalOutput, error) {
+	return nil, fmt.Errorf("no hardware configured for relay pin %v", pin)
+}
+
+func (noBoard) Output(pin int) (DigitalOutput, error) {
+	return nil, fmt.Errorf("no hardware configured for output pin %v", pin)
+}
+
+func (noBoard) LEDs() LEDBank {
+	return noLEDs{}
+}
+
+func (noBoard) Close() error {
+	return nil
+}
+
+type noLEDs struct{}
+
+func (noLEDs) Len() int {
+	return 8
+}
+
+func (noLEDs) Set(led int, value byte) {}
+
+func checkPin(kind string, pin, n int) error {
+	if pin < 0 || pin >= n {
+		return fmt.Errorf("%v pin %v out of range, must be in [0, %v)", kind, pin, n)
+	}
+	return nil
+}
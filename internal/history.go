@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PulseHistory records the times of recent pulses, pulses older than the
+// configured retention period are discarded. It is safe for concurrent use.
+type PulseHistory struct {
+	mu        sync.Mutex
+	retention time.Duration
+	times     []time.Time
+}
+
+// NewPulseHistory creates a new PulseHistory that retains pulses for the
+// specified duration.
+func NewPulseHistory(retention time.Duration) *PulseHistory {
+	return &PulseHistory{retention: retention}
+}
+
+// Retention returns the duration for which pulses are retained.
+func (h *PulseHistory) Retention() time.Duration {
+	return h.retention
+}
+
+// Add records a pulse at the specified time.
+func (h *PulseHistory) Add(when time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n := len(h.times); n == 0 || !when.Before(h.times[n-1]) {
+		h.times = append(h.times, when)
+	} else {
+		i := sort.Search(n, func(i int) bool { return h.times[i].After(when) })
+		h.times = append(h.times, time.Time{})
+		copy(h.times[i+1:], h.times[i:])
+		h.times[i] = when
+	}
+	h.pruneLocked(h.times[len(h.times)-1])
+}
+
+// Reset discards all of the recorded pulses.
+func (h *PulseHistory) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.times = h.times[:0]
+}
+
+func (h *PulseHistory) pruneLocked(now time.Time) {
+	i := h.searchLocked(now.Add(-h.retention))
+	if i == 0 {
+		return
+	}
+	// Reuse the existing storage to avoid growing indefinitely.
+	h.times = h.times[:copy(h.times, h.times[i:])]
+}
+
+// searchLocked returns the index of the first pulse at or after when.
+func (h *PulseHistory) searchLocked(when time.Time) int {
+	return sort.Search(len(h.times), func(i int) bool { return !h.times[i].Before(when) })
+}
+
+// Last returns the time of the most recent pulse, or the zero time if
+// there is none.
+func (h *PulseHistory) Last() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.times) == 0 {
+		return time.Time{}
+	}
+	return h.times[len(h.times)-1]
+}
+
+// CountSince returns the number of pulses at or after the specified time.
+func (h *PulseHistory) CountSince(when time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.times) - h.searchLocked(when)
+}
+
+// Since returns the times of all pulses at or after the specified time.
+func (h *PulseHistory) Since(when time.Time) []time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]time.Time(nil), h.times[h.searchLocked(when):]...)
+}
+
+// BusiestWindow returns the largest number of pulses, at or after since,
+// that occurred within any period of the specified duration together
+// with the times of the first and last of those pulses.
+func (h *PulseHistory) BusiestWindow(since time.Time, window time.Duration) (int, time.Time, time.Time) {
+	times := h.Since(since)
+	var n int
+	var start, end time.Time
+	for i, j := 0, 0; j < len(times); j++ {
+		for times[j].Sub(times[i]) >= window {
+			i++
+		}
+		if c := j - i + 1; c > n {
+			n, start, end = c, times[i], times[j]
+		}
+	}
+	return n, start, end
+}
+
+// MinimumCount returns the smallest number of pulses in any of the
+// consecutive periods of the specified duration that fit between start
+// and end, or zero if none do.
+func (h *PulseHistory) MinimumCount(start, end time.Time, period time.Duration) int {
+	times := h.Since(start)
+	min := -1
+	for from := start; !from.Add(period).After(end); from = from.Add(period) {
+		to := from.Add(period)
+		n := 0
+		for len(times) > 0 && times[0].Before(to) {
+			n++
+			times = times[1:]
+		}
+		if min < 0 || n < min {
+			min = n
+		}
+	}
+	if min < 0 {
+		return 0
+	}
+	return min
+}
+
+// LastRun returns the number of pulses in the most recent run of pulses,
+// ie. pulses each separated from the previous one by less than gap,
+// together with the times of the first and last pulses in the run.
+func (h *PulseHistory) LastRun(gap time.Duration) (int, time.Time, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := len(h.times)
+	if n == 0 {
+		return 0, time.Time{}, time.Time{}
+	}
+	i := n - 1
+	for i > 0 && h.times[i].Sub(h.times[i-1]) < gap {
+		i--
+	}
+	return n - i, h.times[i], h.times[n-1]
+}
+
+// Idle returns true if there was a period of at least idle without any
+// pulses between from and to.
+func (h *PulseHistory) Idle(from, to time.Time, idle time.Duration) bool {
+	prev := from
+	for _, t := range h.Since(from) {
+		if t.After(to) {
+			break
+		}
+		if t.Sub(prev) >= idle {
+			return true
+		}
+		prev = t
+	}
+	return to.Sub(prev) >= idle
+}
+
+// ReadRecentTimestamps returns the total number of timestamps in the
+// specified timestamp file and those timestamps at or after since. The
+// file is read backwards from the end so that only the recent portion of
+// a large file need be read. A missing file is treated as being empty.
+func ReadRecentTimestamps(filename string, since time.Time) (int64, []time.Time, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil, nil
+		}
+		return 0, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	total := fi.Size() / 8
+	const chunk = 4096
+	buf := make([]byte, chunk*8)
+	var recent []time.Time
+	for end := total; end > 0; {
+		start := end - chunk
+		if start < 0 {
+			start = 0
+		}
+		b := buf[:(end-start)*8]
+		if _, err := f.ReadAt(b, start*8); err != nil && err != io.EOF {
+			return 0, nil, fmt.Errorf("failed reading %v: %v", filename, err)
+		}
+		for i := len(b) - 8; i >= 0; i -= 8 {
+			ts := time.Unix(0, int64(binary.LittleEndian.Uint64(b[i:])))
+			if ts.Before(since) {
+				reverse(recent)
+				return total, recent, nil
+			}
+			recent = append(recent, ts)
+		}
+		end = start
+	}
+	reverse(recent)
+	return total, recent, nil
+}
+
+func reverse(times []time.Time) {
+	for i, j := 0, len(times)-1; i < j; i, j = i+1, j-1 {
+		times[i], times[j] = times[j], times[i]
+	}
+}
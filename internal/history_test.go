@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadRecentTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	ts := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+	// The file is read backwards in chunks of 4096 timestamps.
+	for i, tc := range []struct {
+		n, since int
+	}{
+		{0, 0},
+		{1, 0},
+		{1, 1},
+		{10, 5},
+		{4096, 0},
+		{4096, 1},
+		{4097, 1},
+		{10000, 0},
+		{10000, 4095},
+		{10000, 5904},
+		{10000, 5905},
+		{10000, 9999},
+		{10000, 10000},
+	} {
+		filename := filepath.Join(dir, fmt.Sprintf("%v.ts", i))
+		wr, err := NewTimestampFileWriter(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var times []time.Time
+		for j := 0; j < tc.n; j++ {
+			times = append(times, ts(j))
+			if err := wr.Append(ts(j)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wr.Close()
+		total, recent, err := ReadRecentTimestamps(filename, ts(tc.since))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := total, int64(tc.n); got != want {
+			t.Errorf("%v: got total %v, want %v", i, got, want)
+		}
+		want := times[tc.since:]
+		if len(recent) != len(want) {
+			t.Errorf("%v: got %v recent timestamps, want %v", i, len(recent), len(want))
+			continue
+		}
+		for j := range recent {
+			if !recent[j].Equal(want[j]) {
+				t.Errorf("%v: %v: got %v, want %v", i, j, recent[j], want[j])
+				break
+			}
+		}
+	}
+
+	// A missing file is treated as being empty.
+	total, recent, err := ReadRecentTimestamps(filepath.Join(dir, "missing.ts"), start)
+	if err != nil || total != 0 || len(recent) != 0 {
+		t.Errorf("got %v, %v, %v for a missing file", total, recent, err)
+	}
+}
+
+func TestPulseHistoryMinimumCount(t *testing.T) {
+	start := time.Date(2020, 7, 4, 23, 0, 0, 0, time.UTC)
+	min := func(m ...int) []time.Time {
+		var times []time.Time
+		for _, n := range m {
+			times = append(times, start.Add(time.Duration(n)*time.Minute))
+		}
+		return times
+	}
+	// Every minute for the whole of the period.
+	var always []int
+	for i := -5; i < 6*60+5; i++ {
+		always = append(always, i)
+	}
+
+	for i, tc := range []struct {
+		pulses []time.Time
+		hours  int
+		period time.Duration
+		min    int
+	}{
+		{nil, 6, 15 * time.Minute, 0},
+		{min(always...), 6, 15 * time.Minute, 15},
+		{min(always...), 6, time.Hour, 60},
+		// A single pulse in each 15 minute period, across midnight.
+		{min(0, 15, 30, 45, 60, 75, 90, 105), 2, 15 * time.Minute, 1},
+		{min(0, 15, 30, 45, 60, 75, 105), 2, 15 * time.Minute, 0},
+		// A pulse at the end of a period belongs to the next one.
+		{min(0, 14, 15, 30, 45, 59, 60, 75, 90, 105, 119, 120), 2, 15 * time.Minute, 1},
+		// Pulses before the start or after the end are ignored.
+		{min(-1, 120, 121), 2, time.Hour, 0},
+		// Periods that do not fit are ignored.
+		{min(always...), 2, 45 * time.Minute, 45},
+		{min(always...), 2, 3 * time.Hour, 0},
+	} {
+		h := NewPulseHistory(48 * time.Hour)
+		for _, p := range tc.pulses {
+			h.Add(p)
+		}
+		end := start.Add(time.Duration(tc.hours) * time.Hour)
+		if got, want := h.MinimumCount(start, end, tc.period), tc.min; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
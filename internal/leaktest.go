@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultLeakTestDuration is the default duration of a leak test.
+const DefaultLeakTestDuration = 15 * time.Minute
+
+// LeakTestResult records the outcome of a leak test, ie. a period during
+// which no water was being used and hence no pulses were expected.
+type LeakTestResult struct {
+	Meter string    `json:"meter"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Pulses are the times of the pulses seen during the test.
+	Pulses []time.Time `json:"pulses"`
+	// Allowance is the number of pulses permitted for the test to pass.
+	Allowance int64 `json:"allowance"`
+	Passed    bool  `json:"passed"`
+}
+
+// AppendLeakTestResult appends the result, as a single line of JSON, to
+// the specified file.
+func AppendLeakTestResult(filename string, result *LeakTestResult) error {
+	buf, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %v: %v", filename, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %v: %v", filename, err)
+	}
+	return f.Close()
+}
+
+// ReadLeakTestResults reads all of the results recorded in the specified
+// file, a missing file is treated as being empty.
+func ReadLeakTestResults(filename string) ([]LeakTestResult, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var results []LeakTestResult
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var result LeakTestResult
+		if err := json.Unmarshal(sc.Bytes(), &result); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %v: %v", filename, err)
+		}
+		results = append(results, result)
+	}
+	return results, sc.Err()
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/luismesas/goPi/MCP23S17"
+	"github.com/luismesas/goPi/piface"
+	"github.com/luismesas/goPi/spi"
+)
+
+// PiFaceBoard is an implementation of Board for the PiFace 2.
+type PiFaceBoard struct {
+	pfd *piface.PiFaceDigital
+}
+
+// NewPiFaceBoard creates and initializes a PiFace 2 board.
+func NewPiFaceBoard() (*PiFaceBoard, error) {
+	pfd := piface.NewPiFaceDigital(spi.DEFAULT_HARDWARE_ADDR, spi.DEFAULT_BUS, spi.DEFAULT_CHIP)
+	if err := pfd.InitBoard(); err != nil {
+		return nil, fmt.Errorf("failed to initialize piface board: %v", err)
+	}
+	return &PiFaceBoard{pfd: pfd}, nil
+}
+
+type pifaceOutput struct {
+	*MCP23S17.MCP23S17RegisterBit
+}
+
+func (po pifaceOutput) On() {
+	po.AllOn()
+}
+
+func (po pifaceOutput) Off() {
+	po.AllOff()
+}
+
+type pifaceLEDs []*MCP23S17.MCP23S17RegisterBit
+
+func (pl pifaceLEDs) Len() int {
+	return len(pl)
+}
+
+func (pl pifaceLEDs) Set(led int, value byte) {
+	pl[led].SetValue(value)
+}
+
+// Input implements Board.
+func (pb *PiFaceBoard) Input(pin int) (DigitalInput, error) {
+	if err := checkPin("input", pin, len(pb.pfd.InputPins)); err != nil {
+		return nil, err
+	}
+	return pb.pfd.InputPins[pin], nil
+}
+
+// Relay implements Board.
+func (pb *PiFaceBoard) Relay(pin int) (DigitalOutput, error) {
+	if err := checkPin("relay", pin, len(pb.pfd.Relays)); err != nil {
+		return nil, err
+	}
+	return pifaceOutput{pb.pfd.Relays[pin]}, nil
+}
+
+// Output implements Board.
+func (pb *PiFaceBoard) Output(pin int) (DigitalOutput, error) {
+	if err := checkPin("output", pin, len(pb.pfd.OutputPins)); err != nil {
+		return nil, err
+	}
+	return pifaceOutput{pb.pfd.OutputPins[pin]}, nil
+}
+
+// LEDs implements Board.
+func (pb *PiFaceBoard) LEDs() LEDBank {
+	return pifaceLEDs(pb.pfd.Leds)
+}
+
+// Close implements Board.
+func (pb *PiFaceBoard) Close() error {
+	return pb.pfd.Close()
+}
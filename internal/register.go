@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// RegisterAnchor records a reading of a meter's physical register and the
+// number of pulses in the meter's timestamp file at the time of that
+// reading. The current register is derived from the anchor and the
+// number of pulses recorded since then, and hence is as durable as the
+// anchor and timestamp files.
+type RegisterAnchor struct {
+	// Reading is the value of the physical register, in the meter's units.
+	Reading float64 `json:"reading"`
+	// Time is the time at which the register was read.
+	Time time.Time `json:"time"`
+	// Pulses is the number of pulses in the timestamp file at Time.
+	Pulses int64 `json:"pulses"`
+}
+
+// NewRegisterAnchor creates a RegisterAnchor for a reading taken at the
+// specified time using the pulses recorded in timestampFile to determine
+// the number of pulses at that time.
+func NewRegisterAnchor(timestampFile string, reading float64, at time.Time) (*RegisterAnchor, error) {
+	pulses, err := CountTimestamps(timestampFile, at)
+	if err != nil {
+		return nil, err
+	}
+	return &RegisterAnchor{Reading: reading, Time: at.Round(0), Pulses: pulses}, nil
+}
+
+// Register returns the register value given the total number of pulses
+// in the timestamp file.
+func (ra *RegisterAnchor) Register(pulses int64, unitsPerPulse float64) float64 {
+	return ra.Reading + float64(pulses-ra.Pulses)*unitsPerPulse
+}
+
+// ReadRegisterAnchor reads a RegisterAnchor from the specified file.
+func ReadRegisterAnchor(filename string) (*RegisterAnchor, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var ra RegisterAnchor
+	if err := json.Unmarshal(buf, &ra); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %v: %v", filename, err)
+	}
+	return &ra, nil
+}
+
+// WriteRegisterAnchor durably writes the RegisterAnchor to the specified
+// file.
+func WriteRegisterAnchor(filename string, ra *RegisterAnchor) error {
+	buf, err := json.MarshalIndent(ra, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileDurably(filename, buf)
+}
+
+// CountTimestamps returns the number of timestamps in the specified
+// timestamp file that are at or before the specified time. A missing
+// file is treated as being empty.
+func CountTimestamps(filename string, at time.Time) (int64, error) {
+	rd, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer rd.Close()
+	var n int64
+	sc := NewTimestampFileScanner(rd)
+	for sc.Scan() {
+		if sc.Time().After(at) {
+			break
+		}
+		n++
+	}
+	return n, sc.Err()
+}
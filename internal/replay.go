@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// TimestampReplayer replays the pulses recorded in a timestamp file with
+// the same relative timing as they were originally recorded.
+type TimestampReplayer struct {
+	filename string
+}
+
+// NewTimestampReplayer creates a new TimestampReplayer for the specified
+// file.
+func NewTimestampReplayer(filename string) *TimestampReplayer {
+	return &TimestampReplayer{filename: filename}
+}
+
+// Replay calls pulse for each timestamp in the file once the interval
+// between it and the first timestamp has elapsed since start, as measured
+// by clock. The originally recorded timestamp and the time at which it is
+// replayed are passed to pulse. Replaying faster than real time requires
+// a clock that runs faster, such as a SimulatedClock that is advanced
+// accordingly. Replay returns ctx.Err() if ctx is cancelled before all of
+// the pulses are replayed.
+func (tr *TimestampReplayer) Replay(ctx context.Context, clock Clock, start time.Time, pulse func(recorded, replayed time.Time)) error {
+	rd, err := os.Open(tr.filename)
+	if err != nil {
+		return fmt.Errorf("failed to open %v: %v", tr.filename, err)
+	}
+	defer rd.Close()
+	var first time.Time
+	sc := NewTimestampFileScanner(rd)
+	for sc.Scan() {
+		ts := sc.Time()
+		if first.IsZero() {
+			first = ts
+		}
+		when := start.Add(ts.Sub(first))
+		if wait := when.Sub(clock.Now()); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-clock.After(wait):
+			}
+		}
+		pulse(ts, when)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed reading %v: %v", tr.filename, err)
+	}
+	return nil
+}
+
+func (tr *TimestampReplayer) String() string {
+	return tr.filename
+}
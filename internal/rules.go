@@ -0,0 +1,400 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Supported values for the type of an AlertRule.
+const (
+	// RateAboveRule fires when more than Pulses pulses occur within any
+	// period of Window.
+	RateAboveRule = "rate_above"
+	// RateBelowRule fires when fewer than Pulses pulses occur within the
+	// most recent Window, Pulses of 1 detects no flow at all.
+	RateBelowRule = "rate_below"
+	// NoIdleRule fires when there has been no period of at least Idle
+	// without any pulses within the most recent Window.
+	NoIdleRule = "no_idle"
+	// ContinuousRunRule fires when a single continuous usage event, ie.
+	// a run of pulses each separated by less than Idle, exceeds Pulses or
+	// Volume or lasts for longer than Window, at least one of which must
+	// be set. It is evaluated as each pulse is counted so that a burst
+	// pipe is detected as soon as possible.
+	ContinuousRunRule = "continuous_run"
+	// NightMinimumRule fires when the minimum flow, ie. the smallest
+	// number of pulses in any Window, during the quiet period specified
+	// by Between exceeds Pulses for Nights consecutive nights. It detects
+	// slow leaks that never trigger the other rules.
+	NightMinimumRule = "night_minimum"
+	// BaselineRule fires when the number of pulses in the most recent
+	// complete hour differs from the meter's learnt baseline for that
+	// hour of the week by more than ZScore standard deviations. It
+	// requires that the meter's baseline_weeks be set.
+	BaselineRule = "baseline"
+	// ScheduledUsageRule declares a scheduled period of usage, eg. for
+	// irrigation, specified by Between and Days. It fires when the
+	// volume used during the most recent such period is less than
+	// MinVolume or more than MaxVolume, whichever are set. Rules with
+	// ExceptScheduled set do not apply during these periods.
+	ScheduledUsageRule = "scheduled_usage"
+)
+
+// Supported values for the type of an AlertRule that detect faults with
+// the sensor rather than unusual flow.
+const (
+	// StuckClosedRule fires when the input has been continuously closed
+	// for longer than Window, ie. longer than any plausible pulse, eg.
+	// because the meter has stopped with its magnet over a reed switch.
+	StuckClosedRule = "stuck_closed"
+	// ChatteringRule fires when more than Pulses glitches, or pulses
+	// closer together than is possible given the meter's max_flow_rate,
+	// occur within Window, eg. because a reed switch is failing.
+	ChatteringRule = "chattering"
+	// LostPulsesRule fires when there are no pulses in the most recent
+	// complete hour even though the meter's learnt baseline shows that
+	// there have always been pulses in that hour of the week. It
+	// requires that the meter's baseline_weeks be set.
+	LostPulsesRule = "lost_pulses"
+)
+
+// DefaultZScore is the default threshold for baseline rules.
+const DefaultZScore = 3.0
+
+// DefaultNightMinimumWindow is the default window over which the minimum
+// flow is measured by night_minimum rules.
+const DefaultNightMinimumWindow = 15 * time.Minute
+
+// Supported values for the severity of an AlertRule.
+const (
+	InfoSeverity     = "info"
+	WarningSeverity  = "warning"
+	CriticalSeverity = "critical"
+)
+
+// Supported values for the channels of an AlertRule.
+const (
+	// ConsoleChannel writes alerts to stdout.
+	ConsoleChannel = "console"
+	// EmailChannel sends alerts as emails.
+	EmailChannel = "email"
+)
+
+// DefaultResolveAfter is the default period for which an alert rule must
+// have stopped firing for before it is considered to be resolved.
+const DefaultResolveAfter = 10 * time.Minute
+
+// AlertRule represents a declarative alert rule. Each rule either fires
+// or is resolved, a notification is sent when it starts to fire, and
+// optionally periodically thereafter, and when it is resolved.
+type AlertRule struct {
+	// Name identifies the rule in alerts.
+	Name string `json:"name"`
+	// Type is one of rate_above, rate_below, no_idle, continuous_run,
+	// night_minimum, baseline or scheduled_usage to detect unusual flow
+	// or one of stuck_closed, chattering or lost_pulses to detect sensor
+	// faults.
+	Type string `json:"type"`
+	// Window and Idle are in time.Duration format, their use depends on
+	// the type of the rule as does that of Pulses.
+	Window string `json:"window"`
+	Idle   string `json:"idle"`
+	Pulses int64  `json:"pulses"`
+	// Volume is in the meter's units, it is only used by continuous_run.
+	Volume float64 `json:"volume"`
+	// MinVolume and MaxVolume are in the meter's units, they are only
+	// used by scheduled_usage.
+	MinVolume float64 `json:"min_volume"`
+	MaxVolume float64 `json:"max_volume"`
+	// Nights is the number of consecutive nights, it is only used by
+	// night_minimum and defaults to 1.
+	Nights int `json:"nights"`
+	// ZScore is only used by baseline and defaults to DefaultZScore.
+	ZScore float64 `json:"z_score"`
+	// Between optionally restricts the rule to a time of day, in local
+	// time and HH:MM-HH:MM format, eg. 23:00-05:00.
+	Between string `json:"between"`
+	// Days optionally restricts the rule to days of the week, eg. mon or
+	// Monday; a Between period that spans midnight belongs to the day on
+	// which it starts.
+	Days []string `json:"days"`
+	// ExceptScheduled specifies that the rule does not apply during the
+	// meter's scheduled_usage periods and that a rate_above rule only
+	// counts the pulses seen since the most recent such period ended.
+	ExceptScheduled bool `json:"except_scheduled"`
+	// Severity is one of info, warning (the default) or critical.
+	Severity string `json:"severity"`
+	// Channels that alerts are sent to, any of console and email, it
+	// defaults to all of them.
+	Channels []string `json:"channels"`
+	// Shutoff specifies that the meter's shut-off valve is to be closed
+	// when the rule starts to fire.
+	Shutoff bool `json:"shutoff"`
+	// Reminder optionally specifies, in time.Duration format, how often
+	// to send reminders whilst the rule continues to fire.
+	Reminder string `json:"reminder"`
+	// ResolveAfter specifies, in time.Duration format, how long the
+	// rule must have stopped firing for before it is considered to be
+	// resolved, it defaults to DefaultResolveAfter.
+	ResolveAfter string `json:"resolve_after"`
+
+	// Parsed and processed configuration information.
+
+	// Window as a time.Duration.
+	WindowDuration time.Duration `json:"-"`
+	// Idle as a time.Duration.
+	IdleDuration time.Duration `json:"-"`
+	// Reminder as a time.Duration, zero if no reminders are to be sent.
+	ReminderDuration time.Duration `json:"-"`
+	// ResolveAfter as a time.Duration.
+	ResolveAfterDuration time.Duration `json:"-"`
+	// Between as minutes after midnight, From may be greater than To
+	// if the period spans midnight; both are -1 if Between is not set.
+	From, To int `json:"-"`
+	// Days as the days of the week to which the rule applies.
+	Weekdays [7]bool `json:"-"`
+}
+
+// LegacyAlertRules returns the rules equivalent to the alert_interval,
+// alert_pulses, idle_alert_interval and leak_alert_interval options.
+func LegacyAlertRules(meter *MeterConfig) []AlertRule {
+	return []AlertRule{
+		{
+			Name:   "high-flow",
+			Type:   RateAboveRule,
+			Window: meter.AlertInterval,
+			Pulses: meter.AlertPulses,
+		},
+		{
+			Name:   "no-flow",
+			Type:   RateBelowRule,
+			Window: meter.IdleAlertInterval,
+			Pulses: 1,
+		},
+		{
+			Name:     "leak",
+			Type:     NoIdleRule,
+			Window:   meter.LeakAlertInterval,
+			Idle:     meter.IdleAlertInterval,
+			Severity: CriticalSeverity,
+		},
+	}
+}
+
+// DefaultAwayRules returns the away rules used when none are specified,
+// ie. a rule that fires when more than away_allowance pulses occur
+// within an hour.
+func DefaultAwayRules(meter *MeterConfig) []AlertRule {
+	return []AlertRule{
+		{
+			Name:     "away",
+			Type:     RateAboveRule,
+			Window:   "1h",
+			Pulses:   meter.AwayAllowance,
+			Severity: CriticalSeverity,
+			Shutoff:  meter.AwayShutoff,
+		},
+	}
+}
+
+func (rule *AlertRule) parse() error {
+	if len(rule.Name) == 0 {
+		rule.Name = rule.Type
+	}
+	parseDuration := func(option, value string) (time.Duration, error) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("rule %v: failed to parse %v %q as time.Duration: %v", rule.Name, option, value, err)
+		}
+		if d <= 0 {
+			return 0, fmt.Errorf("rule %v: %v must be positive", rule.Name, option)
+		}
+		return d, nil
+	}
+	var err error
+	switch rule.Type {
+	case RateAboveRule, RateBelowRule:
+		rule.WindowDuration, err = parseDuration("window", rule.Window)
+	case NoIdleRule:
+		if rule.WindowDuration, err = parseDuration("window", rule.Window); err == nil {
+			rule.IdleDuration, err = parseDuration("idle", rule.Idle)
+		}
+	case ContinuousRunRule:
+		if rule.Pulses <= 0 && rule.Volume <= 0 && len(rule.Window) == 0 {
+			return fmt.Errorf("rule %v: at least one of pulses, volume or window is required for %v", rule.Name, rule.Type)
+		}
+		if rule.IdleDuration, err = parseDuration("idle", rule.Idle); err == nil && len(rule.Window) > 0 {
+			rule.WindowDuration, err = parseDuration("window", rule.Window)
+		}
+	case NightMinimumRule:
+		if len(rule.Between) == 0 {
+			return fmt.Errorf("rule %v: between is required for %v", rule.Name, rule.Type)
+		}
+		rule.WindowDuration = DefaultNightMinimumWindow
+		if len(rule.Window) > 0 {
+			rule.WindowDuration, err = parseDuration("window", rule.Window)
+		}
+		if rule.Nights <= 0 {
+			rule.Nights = 1
+		}
+	case BaselineRule:
+		if rule.ZScore <= 0 {
+			rule.ZScore = DefaultZScore
+		}
+	case StuckClosedRule, ChatteringRule:
+		rule.WindowDuration, err = parseDuration("window", rule.Window)
+	case LostPulsesRule:
+	case ScheduledUsageRule:
+		if len(rule.Between) == 0 {
+			return fmt.Errorf("rule %v: between is required for %v", rule.Name, rule.Type)
+		}
+		if rule.MinVolume > 0 && rule.MaxVolume > 0 && rule.MinVolume > rule.MaxVolume {
+			return fmt.Errorf("rule %v: min_volume is greater than max_volume", rule.Name)
+		}
+	default:
+		return fmt.Errorf("rule %v: unsupported type: %q", rule.Name, rule.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(rule.Reminder) > 0 {
+		if rule.ReminderDuration, err = parseDuration("reminder", rule.Reminder); err != nil {
+			return err
+		}
+	}
+	rule.ResolveAfterDuration = DefaultResolveAfter
+	if len(rule.ResolveAfter) > 0 {
+		if rule.ResolveAfterDuration, err = time.ParseDuration(rule.ResolveAfter); err != nil {
+			return fmt.Errorf("rule %v: failed to parse resolve_after %q as time.Duration: %v", rule.Name, rule.ResolveAfter, err)
+		}
+	}
+
+	switch rule.Severity {
+	case "":
+		rule.Severity = WarningSeverity
+	case InfoSeverity, WarningSeverity, CriticalSeverity:
+	default:
+		return fmt.Errorf("rule %v: unsupported severity: %q", rule.Name, rule.Severity)
+	}
+
+	if len(rule.Channels) == 0 {
+		rule.Channels = []string{ConsoleChannel, EmailChannel}
+	}
+	for _, ch := range rule.Channels {
+		if ch != ConsoleChannel && ch != EmailChannel {
+			return fmt.Errorf("rule %v: unsupported channel: %q", rule.Name, ch)
+		}
+	}
+
+	rule.From, rule.To = -1, -1
+	if len(rule.Between) > 0 {
+		parts := strings.Split(rule.Between, "-")
+		if len(parts) != 2 {
+			return fmt.Errorf("rule %v: failed to parse between %q in HH:MM-HH:MM format", rule.Name, rule.Between)
+		}
+		from, ferr := time.Parse("15:04", parts[0])
+		to, terr := time.Parse("15:04", parts[1])
+		if ferr != nil || terr != nil {
+			return fmt.Errorf("rule %v: failed to parse between %q in HH:MM-HH:MM format", rule.Name, rule.Between)
+		}
+		rule.From = from.Hour()*60 + from.Minute()
+		rule.To = to.Hour()*60 + to.Minute()
+		if rule.From == rule.To {
+			return fmt.Errorf("rule %v: between %q is empty", rule.Name, rule.Between)
+		}
+	}
+
+	for i := range rule.Weekdays {
+		rule.Weekdays[i] = len(rule.Days) == 0
+	}
+	for _, day := range rule.Days {
+		wd, ok := parseWeekday(day)
+		if !ok {
+			return fmt.Errorf("rule %v: unrecognised day of the week: %q", rule.Name, day)
+		}
+		rule.Weekdays[wd] = true
+	}
+	return nil
+}
+
+func parseWeekday(day string) (time.Weekday, bool) {
+	day = strings.ToLower(day)
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		name := strings.ToLower(wd.String())
+		if day == name || day == name[:3] {
+			return wd, true
+		}
+	}
+	return 0, false
+}
+
+// Active returns true if the rule applies at the specified time, ie. if
+// that time is within the rule's Between period and Days, if any.
+func (rule *AlertRule) Active(when time.Time) bool {
+	if rule.From < 0 {
+		return rule.Weekdays[when.Weekday()]
+	}
+	minute := when.Hour()*60 + when.Minute()
+	if rule.From <= rule.To {
+		return minute >= rule.From && minute < rule.To && rule.Weekdays[when.Weekday()]
+	}
+	if minute >= rule.From {
+		return rule.Weekdays[when.Weekday()]
+	}
+	return minute < rule.To && rule.Weekdays[(when.Weekday()+6)%7]
+}
+
+// LastPeriod returns the start and end of the most recent Between period,
+// that starts on one of the rule's Days, to have ended at or before the
+// specified time, in that time's location.
+func (rule *AlertRule) LastPeriod(when time.Time) (time.Time, time.Time) {
+	y, m, d := when.Date()
+	if time.Date(y, m, d, rule.To/60, rule.To%60, 0, 0, when.Location()).After(when) {
+		d--
+	}
+	for i := 0; ; i++ {
+		end := time.Date(y, m, d-i, rule.To/60, rule.To%60, 0, 0, when.Location())
+		ey, em, ed := end.Date()
+		if rule.From > rule.To {
+			ed--
+		}
+		start := time.Date(ey, em, ed, rule.From/60, rule.From%60, 0, 0, when.Location())
+		// At least one day is always selected.
+		if rule.Weekdays[start.Weekday()] || i >= 7 {
+			return start, end
+		}
+	}
+}
+
+// Retention returns the period of pulse history needed to evaluate
+// the rule.
+func (rule *AlertRule) Retention() time.Duration {
+	switch rule.Type {
+	case NightMinimumRule:
+		// The most recent period may have ended up to a day ago and
+		// the consecutive nights may be up to a week apart if restricted
+		// to certain days.
+		days := rule.Nights + 1
+		if len(rule.Days) > 0 {
+			days = 7*rule.Nights + 1
+		}
+		return time.Duration(days) * 24 * time.Hour
+	case StuckClosedRule, ChatteringRule:
+		// These rules do not use the pulse history.
+		return 0
+	}
+	return rule.WindowDuration + rule.IdleDuration
+}
+
+// SendTo returns true if alerts for the rule are to be sent to the
+// specified channel.
+func (rule *AlertRule) SendTo(channel string) bool {
+	for _, ch := range rule.Channels {
+		if ch == channel {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRuleErrors(t *testing.T) {
+	for i, tc := range []struct {
+		rule AlertRule
+		err  string
+	}{
+		{AlertRule{Type: "unknown"}, `unsupported type: "unknown"`},
+		{AlertRule{Type: RateAboveRule}, `failed to parse window ""`},
+		{AlertRule{Type: RateAboveRule, Window: "1x"}, `failed to parse window "1x"`},
+		{AlertRule{Type: RateBelowRule, Window: "-1m"}, "window must be positive"},
+		{AlertRule{Type: NoIdleRule, Window: "1h"}, `failed to parse idle ""`},
+		{AlertRule{Type: ContinuousRunRule, Idle: "1m"}, "at least one of pulses, volume or window is required"},
+		{AlertRule{Type: ContinuousRunRule, Pulses: 10}, `failed to parse idle ""`},
+		{AlertRule{Type: ContinuousRunRule, Idle: "1m", Window: "0s"}, "window must be positive"},
+		{AlertRule{Type: NightMinimumRule}, "between is required"},
+		{AlertRule{Type: RateAboveRule, Window: "1m", Between: "01:00"}, "HH:MM-HH:MM format"},
+		{AlertRule{Type: RateAboveRule, Window: "1m", Between: "01:00-25:00"}, "HH:MM-HH:MM format"},
+		{AlertRule{Type: NightMinimumRule, Between: "01:00-01:00"}, "is empty"},
+		{AlertRule{Type: RateAboveRule, Window: "1m", Between: "06:00-06:00"}, `between "06:00-06:00" is empty`},
+		{AlertRule{Type: LostPulsesRule, Between: "00:00-00:00"}, "is empty"},
+		{AlertRule{Type: ScheduledUsageRule}, "between is required"},
+		{AlertRule{Type: ScheduledUsageRule, Between: "06:00-07:00", MinVolume: 10, MaxVolume: 5}, "min_volume is greater than max_volume"},
+		{AlertRule{Type: StuckClosedRule}, `failed to parse window ""`},
+		{AlertRule{Type: RateAboveRule, Window: "1m", Reminder: "0s"}, "reminder must be positive"},
+		{AlertRule{Type: RateAboveRule, Window: "1m", ResolveAfter: "soon"}, `failed to parse resolve_after "soon"`},
+		{AlertRule{Type: RateAboveRule, Window: "1m", Severity: "fatal"}, `unsupported severity: "fatal"`},
+		{AlertRule{Type: RateAboveRule, Window: "1m", Channels: []string{"sms"}}, `unsupported channel: "sms"`},
+		{AlertRule{Type: RateAboveRule, Window: "1m", Days: []string{"mon", "funday"}}, `unrecognised day of the week: "funday"`},
+	} {
+		err := tc.rule.parse()
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: %v: got %v, want an error containing %q", i, tc.rule.Type, err, tc.err)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	rule := AlertRule{Type: RateAboveRule, Window: "1m", Between: "23:00-05:00"}
+	if err := rule.parse(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rule.Name, RateAboveRule; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := rule.Severity, WarningSeverity; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !rule.SendTo(ConsoleChannel) || !rule.SendTo(EmailChannel) {
+		t.Errorf("got %v, want all channels", rule.Channels)
+	}
+	if got, want := rule.ResolveAfterDuration, DefaultResolveAfter; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if rule.From != 23*60 || rule.To != 5*60 {
+		t.Errorf("got %v-%v, want %v-%v", rule.From, rule.To, 23*60, 5*60)
+	}
+
+	at := func(h, m int) time.Time { return time.Date(2020, 7, 4, h, m, 0, 0, time.Local) }
+	for i, tc := range []struct {
+		when   time.Time
+		active bool
+	}{
+		{at(0, 0), true},
+		{at(4, 59), true},
+		{at(5, 0), false},
+		{at(12, 0), false},
+		{at(22, 59), false},
+		{at(23, 0), true},
+	} {
+		if got, want := rule.Active(tc.when), tc.active; got != want {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.when, got, want)
+		}
+	}
+}
+
+func TestParseNightMinimumRule(t *testing.T) {
+	rule := AlertRule{Type: NightMinimumRule, Between: "01:00-05:00"}
+	if err := rule.parse(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rule.WindowDuration, DefaultNightMinimumWindow; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := rule.Nights, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRuleDays(t *testing.T) {
+	rule := AlertRule{Type: NightMinimumRule, Between: "23:00-05:00", Days: []string{"Sat", "sunday"}}
+	if err := rule.parse(); err != nil {
+		t.Fatal(err)
+	}
+	// 4th July 2020 is a Saturday, a period that spans midnight belongs
+	// to the day on which it starts.
+	day := func(d, h int) time.Time { return time.Date(2020, 7, d, h, 0, 0, 0, time.Local) }
+	for i, tc := range []struct {
+		when   time.Time
+		active bool
+	}{
+		{day(3, 23), false},
+		{day(4, 4), false},
+		{day(4, 12), false},
+		{day(4, 23), true},
+		{day(5, 4), true},
+		{day(5, 5), false},
+		{day(5, 23), true},
+		{day(6, 4), true},
+		{day(6, 23), false},
+	} {
+		if got, want := rule.Active(tc.when), tc.active; got != want {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.when, got, want)
+		}
+	}
+}
+
+func TestLastPeriod(t *testing.T) {
+	// 4th July 2020 is a Saturday.
+	at := func(d, h, m int) time.Time { return time.Date(2020, 7, d, h, m, 0, 0, time.UTC) }
+	for i, tc := range []struct {
+		between    string
+		days       []string
+		when       time.Time
+		start, end time.Time
+	}{
+		{"01:00-05:00", nil, at(4, 12, 0), at(4, 1, 0), at(4, 5, 0)},
+		{"01:00-05:00", nil, at(4, 5, 0), at(4, 1, 0), at(4, 5, 0)},
+		{"01:00-05:00", nil, at(4, 4, 59), at(3, 1, 0), at(3, 5, 0)},
+		{"01:00-05:00", nil, at(4, 0, 30), at(3, 1, 0), at(3, 5, 0)},
+		// Periods that span midnight.
+		{"23:00-05:00", nil, at(4, 12, 0), at(3, 23, 0), at(4, 5, 0)},
+		{"23:00-05:00", nil, at(4, 23, 30), at(3, 23, 0), at(4, 5, 0)},
+		{"23:00-05:00", nil, at(5, 4, 0), at(3, 23, 0), at(4, 5, 0)},
+		{"23:00-05:00", nil, at(5, 5, 0), at(4, 23, 0), at(5, 5, 0)},
+		{"23:00-05:00", nil, at(1, 5, 0), time.Date(2020, 6, 30, 23, 0, 0, 0, time.UTC), at(1, 5, 0)},
+		// Periods that start on the specified days.
+		{"02:00-03:30", []string{"mon", "wed", "fri"}, at(4, 12, 0), at(3, 2, 0), at(3, 3, 30)},
+		{"02:00-03:30", []string{"mon", "wed", "fri"}, at(3, 3, 0), at(1, 2, 0), at(1, 3, 30)},
+		{"02:00-03:30", []string{"mon", "wed", "fri"}, at(6, 3, 30), at(6, 2, 0), at(6, 3, 30)},
+		{"23:00-05:00", []string{"fri"}, at(4, 12, 0), at(3, 23, 0), at(4, 5, 0)},
+		{"23:00-05:00", []string{"fri"}, at(4, 4, 0), time.Date(2020, 6, 26, 23, 0, 0, 0, time.UTC), time.Date(2020, 6, 27, 5, 0, 0, 0, time.UTC)},
+		{"23:00-05:00", []string{"sat"}, at(6, 4, 0), at(4, 23, 0), at(5, 5, 0)},
+	} {
+		rule := AlertRule{Type: NightMinimumRule, Between: tc.between, Days: tc.days}
+		if err := rule.parse(); err != nil {
+			t.Fatal(err)
+		}
+		start, end := rule.LastPeriod(tc.when)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("%v: %v %v: %v: got %v to %v, want %v to %v", i, tc.between, tc.days, tc.when, start, end, tc.start, tc.end)
+		}
+	}
+}
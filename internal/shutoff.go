@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// DefaultShutoffActuationPeriod is the default period over which the
+// number of actuations of a shut-off valve is limited.
+const DefaultShutoffActuationPeriod = 24 * time.Hour
+
+// ShutoffState represents the state of a shut-off valve. Once closed the
+// valve is latched closed until it is explicitly reset.
+type ShutoffState struct {
+	// Closed is true if the valve has been closed and not yet reset.
+	Closed bool `json:"closed"`
+	// Time is the time at which the valve was last closed or reset.
+	Time time.Time `json:"time"`
+	// Reason describes why the valve was closed.
+	Reason string `json:"reason,omitempty"`
+	// Actuations are the times at which the valve was closed within
+	// the most recent actuation period.
+	Actuations []time.Time `json:"actuations,omitempty"`
+}
+
+// Actuate records the closing of the valve at the specified time for the
+// specified reason. It returns an error, and leaves the state unchanged,
+// if doing so would exceed max actuations, if max is greater than zero,
+// within period.
+func (s *ShutoffState) Actuate(now time.Time, reason string, max int, period time.Duration) error {
+	recent := s.Actuations[:0]
+	for _, t := range s.Actuations {
+		if now.Sub(t) < period {
+			recent = append(recent, t)
+		}
+	}
+	s.Actuations = recent
+	if max > 0 && len(recent) >= max {
+		return fmt.Errorf("already closed %v times in the last %v", len(recent), period)
+	}
+	s.Closed, s.Time, s.Reason = true, now.Round(0), reason
+	s.Actuations = append(s.Actuations, s.Time)
+	return nil
+}
+
+// Reset records the explicit reset, ie. reopening, of the valve at the
+// specified time.
+func (s *ShutoffState) Reset(now time.Time) {
+	s.Closed, s.Time, s.Reason = false, now.Round(0), ""
+}
+
+// ReadShutoffState reads a ShutoffState from the specified file, a
+// missing file is treated as an open valve.
+func ReadShutoffState(filename string) (*ShutoffState, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &ShutoffState{}, nil
+		}
+		return nil, err
+	}
+	var s ShutoffState
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %v: %v", filename, err)
+	}
+	return &s, nil
+}
+
+// WriteShutoffState durably writes the ShutoffState to the specified file.
+func WriteShutoffState(filename string, s *ShutoffState) error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileDurably(filename, buf)
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutoffStateActuate(t *testing.T) {
+	start := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	var state ShutoffState
+	for i, tc := range []struct {
+		hour       int
+		reset      bool
+		max        int
+		err        string
+		actuations int
+	}{
+		{0, false, 2, "", 1},
+		{1, true, 2, "", 1},
+		{2, false, 2, "", 2},
+		{3, true, 2, "", 2},
+		// A third actuation within 24 hours is refused.
+		{4, false, 2, "already closed 2 times in the last 24h0m0s", 2},
+		// Unless there is no maximum.
+		{4, false, 0, "", 3},
+		{5, true, 2, "", 3},
+		// Actuations expire once they are more than 24 hours old.
+		{24, false, 2, "already closed 2 times in the last 24h0m0s", 2},
+		{26, false, 2, "", 2},
+	} {
+		now := start.Add(time.Duration(tc.hour) * time.Hour)
+		if tc.reset {
+			state.Reset(now)
+			if state.Closed || !state.Time.Equal(now) || len(state.Reason) > 0 {
+				t.Errorf("%v: reset: got %+v", i, state)
+			}
+		} else {
+			prev := state
+			err := state.Actuate(now, "burst", tc.max, 24*time.Hour)
+			switch {
+			case len(tc.err) == 0 && err != nil:
+				t.Errorf("%v: unexpected error: %v", i, err)
+			case len(tc.err) > 0 && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("%v: got %v, want an error containing %q", i, err, tc.err)
+			case err != nil && (state.Closed != prev.Closed || !state.Time.Equal(prev.Time)):
+				t.Errorf("%v: a refused actuation changed the state: %+v", i, state)
+			case err == nil && (!state.Closed || !state.Time.Equal(now) || state.Reason != "burst"):
+				t.Errorf("%v: got %+v, want closed at %v", i, state, now)
+			}
+		}
+		if got, want := len(state.Actuations), tc.actuations; got != want {
+			t.Errorf("%v: got %v actuations, want %v", i, got, want)
+		}
+	}
+}
+
+func TestShutoffStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "valve.json")
+
+	// A missing file is an open valve.
+	state, err := ReadShutoffState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Closed {
+		t.Errorf("got %+v, want an open valve", state)
+	}
+	now := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	if err := state.Actuate(now, "burst", 0, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteShutoffState(filename, state); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ReadShutoffState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Closed || !restored.Time.Equal(now) || restored.Reason != "burst" || len(restored.Actuations) != 1 {
+		t.Errorf("got %+v, want %+v", restored, state)
+	}
+}
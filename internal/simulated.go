@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SimulatedTransition represents a scripted change to a simulated input pin.
+type SimulatedTransition struct {
+	// Pin is the input pin to change.
+	Pin int `json:"pin"`
+	// DelayMS is the delay, in milliseconds, since the previous transition
+	// (or the start of the script) before this transition takes effect.
+	DelayMS int `json:"delay_ms"`
+	// Value is the new value for the pin, 1 for closed and 0 for open.
+	Value byte `json:"value"`
+}
+
+const simulatedPins = 8
+
+// SimulatedBoard is an in-memory implementation of Board whose inputs
+// are driven by a script of transitions and/or by calls to SetInput. Its
+// inputs implement EdgeSource.
+type SimulatedBoard struct {
+	inputs  [simulatedPins]simulatedInput
+	relays  [simulatedPins]SimulatedOutput
+	outputs [simulatedPins]SimulatedOutput
+	leds    simulatedLEDs
+	done    chan struct{}
+	once    sync.Once
+}
+
+type simulatedInput struct {
+	mu    sync.Mutex
+	value byte
+	edges chan Edge
+}
+
+func (si *simulatedInput) Value() byte {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	return si.value
+}
+
+// Edges implements EdgeSource.
+func (si *simulatedInput) Edges() <-chan Edge {
+	return si.edges
+}
+
+func (si *simulatedInput) set(value byte) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if si.value == value {
+		return
+	}
+	si.value = value
+	select {
+	case si.edges <- Edge{Time: time.Now(), Value: value}:
+	default:
+	}
+}
+
+// SimulatedOutput is the simulated implementation of DigitalOutput, it
+// records the current state and the number of times it has been turned on.
+type SimulatedOutput struct {
+	state int32
+	count int64
+}
+
+// On implements DigitalOutput.
+func (so *SimulatedOutput) On() {
+	atomic.StoreInt32(&so.state, 1)
+	atomic.AddInt64(&so.count, 1)
+}
+
+// Off implements DigitalOutput.
+func (so *SimulatedOutput) Off() {
+	atomic.StoreInt32(&so.state, 0)
+}
+
+// State returns the current state of the output.
+func (so *SimulatedOutput) State() byte {
+	return byte(atomic.LoadInt32(&so.state))
+}
+
+// Count returns the number of times that the output has been turned on.
+func (so *SimulatedOutput) Count() int64 {
+	return atomic.LoadInt64(&so.count)
+}
+
+type simulatedLEDs struct {
+	values [simulatedPins]int32
+}
+
+func (sl *simulatedLEDs) Len() int {
+	return len(sl.values)
+}
+
+func (sl *simulatedLEDs) Set(led int, value byte) {
+	atomic.StoreInt32(&sl.values[led], int32(value))
+}
+
+// NewSimulatedBoard creates a new SimulatedBoard and starts playing the
+// supplied script of input transitions, repeating it if repeat is true.
+func NewSimulatedBoard(script []SimulatedTransition, repeat bool) *SimulatedBoard {
+	sb := &SimulatedBoard{done: make(chan struct{})}
+	for i := range sb.inputs {
+		sb.inputs[i].edges = make(chan Edge, 1024)
+	}
+	if len(script) > 0 {
+		go sb.play(script, repeat)
+	}
+	return sb
+}
+
+func (sb *SimulatedBoard) play(script []SimulatedTransition, repeat bool) {
+	for {
+		for _, tr := range script {
+			select {
+			case <-sb.done:
+				return
+			case <-time.After(time.Duration(tr.DelayMS) * time.Millisecond):
+			}
+			sb.SetInput(tr.Pin, tr.Value)
+		}
+		if !repeat {
+			return
+		}
+	}
+}
+
+// SetInput sets the value of the specified input pin.
+func (sb *SimulatedBoard) SetInput(pin int, value byte) {
+	if checkPin("input", pin, simulatedPins) != nil {
+		return
+	}
+	sb.inputs[pin].set(value)
+}
+
+// Input implements Board.
+func (sb *SimulatedBoard) Input(pin int) (DigitalInput, error) {
+	if err := checkPin("input", pin, simulatedPins); err != nil {
+		return nil, err
+	}
+	return &sb.inputs[pin], nil
+}
+
+// Relay implements Board.
+func (sb *SimulatedBoard) Relay(pin int) (DigitalOutput, error) {
+	if err := checkPin("relay", pin, simulatedPins); err != nil {
+		return nil, err
+	}
+	return &sb.relays[pin], nil
+}
+
+// Output implements Board.
+func (sb *SimulatedBoard) Output(pin int) (DigitalOutput, error) {
+	if err := checkPin("output", pin, simulatedPins); err != nil {
+		return nil, err
+	}
+	return &sb.outputs[pin], nil
+}
+
+// LEDs implements Board.
+func (sb *SimulatedBoard) LEDs() LEDBank {
+	return &sb.leds
+}
+
+// Close implements Board and stops any running script.
+func (sb *SimulatedBoard) Close() error {
+	sb.once.Do(func() { close(sb.done) })
+	return nil
+}
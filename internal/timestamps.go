@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -34,6 +35,96 @@ func (tf *TimestampFileWriter) Append(ts time.Time) error {
 	return nil
 }
 
+// AppendBatch appends multiple timestamps to the underlying file using
+// a single write. It returns the number of timestamps that were written,
+// any partially written timestamp is removed from the file so that only
+// the remainder need be retried following an error.
+func (tf *TimestampFileWriter) AppendBatch(ts []time.Time) (int, error) {
+	buf := make([]byte, len(ts)*8)
+	for i, t := range ts {
+		binary.LittleEndian.PutUint64(buf[i*8:], uint64(t.UnixNano()))
+	}
+	n, err := tf.appendRecords(buf, 8)
+	if err != nil {
+		return n, fmt.Errorf("failed writing/appending to timestamp file %v: %v", tf.name, err)
+	}
+	return n, nil
+}
+
+// appendRecords writes buf, which contains records of the specified size,
+// and returns the number of complete records written. If a record is only
+// partially written it is truncated from the file, when possible.
+func (tf *TimestampFileWriter) appendRecords(buf []byte, size int) (int, error) {
+	n, err := tf.Write(buf)
+	if err == nil {
+		return n / size, nil
+	}
+	if partial := n % size; partial > 0 {
+		if terr := tf.truncate(int64(partial)); terr != nil {
+			err = fmt.Errorf("%v: and failed to remove partial record: %v", err, terr)
+		}
+	}
+	return n / size, err
+}
+
+// truncater is implemented by *os.File.
+type truncater interface {
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// truncate removes the last n bytes from the underlying file.
+func (tf *TimestampFileWriter) truncate(n int64) error {
+	f, ok := tf.WriteCloser.(truncater)
+	if !ok {
+		return fmt.Errorf("%T cannot be truncated", tf.WriteCloser)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return f.Truncate(fi.Size() - n)
+}
+
+// PulseWidth records the rising and falling edge times of a single pulse,
+// ie. how long the reed switch remained closed.
+type PulseWidth struct {
+	Rising, Falling time.Time
+}
+
+// Width returns the duration of the pulse.
+func (pw PulseWidth) Width() time.Duration {
+	return pw.Falling.Sub(pw.Rising)
+}
+
+// AppendPulseWidth appends the rising and falling edge times of a pulse
+// as a pair of timestamps to the underlying file.
+func (tf *TimestampFileWriter) AppendPulseWidth(pw PulseWidth) error {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf, uint64(pw.Rising.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(pw.Falling.UnixNano()))
+	if _, err := tf.Write(buf); err != nil {
+		return fmt.Errorf("failed writing/appending to pulse width file %v: %v", tf.name, err)
+	}
+	return nil
+}
+
+// AppendPulseWidths appends multiple pulse widths to the underlying file
+// using a single write. Like AppendBatch, it returns the number of pulse
+// widths that were written.
+func (tf *TimestampFileWriter) AppendPulseWidths(pws []PulseWidth) (int, error) {
+	buf := make([]byte, len(pws)*16)
+	for i, pw := range pws {
+		binary.LittleEndian.PutUint64(buf[i*16:], uint64(pw.Rising.UnixNano()))
+		binary.LittleEndian.PutUint64(buf[i*16+8:], uint64(pw.Falling.UnixNano()))
+	}
+	n, err := tf.appendRecords(buf, 16)
+	if err != nil {
+		return n, fmt.Errorf("failed writing/appending to pulse width file %v: %v", tf.name, err)
+	}
+	return n, nil
+}
+
 // TimestampFileScanner represents a scanner for a timestamp file.
 type TimestampFileScanner struct {
 	ts  int64
@@ -68,8 +159,56 @@ func (ts *TimestampFileScanner) Time() time.Time {
 	return time.Unix(0, ts.ts)
 }
 
-// ReadTimestamps read and print the timestamps.
-func ReadTimestamps(filename string, from, to time.Time) error {
+// PulseWidthFileScanner represents a scanner for a pulse width file, which
+// contains pairs of timestamps for the rising and falling edge of each
+// pulse.
+type PulseWidthFileScanner struct {
+	sc *TimestampFileScanner
+	pw PulseWidth
+}
+
+// NewPulseWidthFileScanner creates a new PulseWidthFileScanner.
+func NewPulseWidthFileScanner(rd io.Reader) *PulseWidthFileScanner {
+	return &PulseWidthFileScanner{sc: NewTimestampFileScanner(rd)}
+}
+
+// Err is analagous to bufio.Scanner.Err.
+func (ps *PulseWidthFileScanner) Err() error {
+	return ps.sc.Err()
+}
+
+// Scan is analagous to bufio.Scanner.Scan.
+func (ps *PulseWidthFileScanner) Scan() bool {
+	if !ps.sc.Scan() {
+		return false
+	}
+	rising := ps.sc.Time()
+	if !ps.sc.Scan() {
+		return false
+	}
+	ps.pw = PulseWidth{Rising: rising, Falling: ps.sc.Time()}
+	return true
+}
+
+// PulseWidth is analogous to bufio.Scanner.Bytes.
+func (ps *PulseWidthFileScanner) PulseWidth() PulseWidth {
+	return ps.pw
+}
+
+// DumpOptions represents optional columns for ReadTimestamps.
+type DumpOptions struct {
+	// WidthsFile, if set, is the pulse width file to read the width of
+	// each pulse from.
+	WidthsFile string
+	// Register, if set, is used to display the meter's register after
+	// each pulse.
+	Register      *RegisterAnchor
+	UnitsPerPulse float64
+}
+
+// ReadTimestamps read and print the timestamps, and optionally the
+// width of each pulse and the register as specified by opts.
+func ReadTimestamps(filename string, from, to time.Time, opts DumpOptions) error {
 	var rd *os.File
 	var err error
 	if filename == "-" {
@@ -81,16 +220,52 @@ func ReadTimestamps(filename string, from, to time.Time) error {
 		}
 	}
 	defer rd.Close()
+	var widths *PulseWidthFileScanner
+	header := "pulse\tnanosecond\ttime"
+	if len(opts.WidthsFile) > 0 {
+		wr, err := os.Open(opts.WidthsFile)
+		if err != nil {
+			return err
+		}
+		defer wr.Close()
+		widths = NewPulseWidthFileScanner(wr)
+		if !widths.Scan() {
+			widths = nil
+		}
+		header += "\twidth"
+	}
+	if opts.Register != nil {
+		header += "\tregister"
+	}
+	fmt.Println(header)
 	pulseCounter := 0
-	fmt.Printf("pulse\tnanosecond\ttime\n")
 	sc := NewTimestampFileScanner(rd)
+	line := &strings.Builder{}
 	for sc.Scan() {
 		pulseCounter++
 		ns := sc.Time()
 		if from.After(ns) || to.Before(ns) {
 			continue
 		}
-		fmt.Printf("%v\t%v\t%v\n", pulseCounter, ns.UnixNano(), ns)
+		line.Reset()
+		fmt.Fprintf(line, "%v\t%v\t%v", pulseCounter, ns.UnixNano(), ns)
+		if len(opts.WidthsFile) > 0 {
+			// Both files are in time order, so skip any widths for earlier pulses.
+			for widths != nil && widths.PulseWidth().Rising.Before(ns) {
+				if !widths.Scan() {
+					widths = nil
+				}
+			}
+			width := "-"
+			if widths != nil && widths.PulseWidth().Rising.Equal(ns) {
+				width = widths.PulseWidth().Width().String()
+			}
+			fmt.Fprintf(line, "\t%v", width)
+		}
+		if opts.Register != nil {
+			fmt.Fprintf(line, "\t%.1f", opts.Register.Register(int64(pulseCounter), opts.UnitsPerPulse))
+		}
+		fmt.Println(line.String())
 	}
 	return sc.Err()
 }
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// shortFile is an os.File whose writes fail once limit bytes have been
+// written.
+type shortFile struct {
+	*os.File
+	limit int
+}
+
+func (f *shortFile) Write(buf []byte) (int, error) {
+	if len(buf) <= f.limit {
+		n, err := f.File.Write(buf)
+		f.limit -= n
+		return n, err
+	}
+	n, _ := f.File.Write(buf[:f.limit])
+	f.limit -= n
+	return n, errors.New("no space left on device")
+}
+
+func TestAppendPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	times := []time.Time{start, start.Add(time.Second), start.Add(2 * time.Second)}
+	widths := []PulseWidth{{times[0], times[1]}, {times[1], times[2]}}
+	for i, tc := range []struct {
+		widths  bool
+		limit   int
+		written int
+		err     bool
+	}{
+		{false, 0, 0, true},
+		{false, 5, 0, true},
+		{false, 8, 1, true},
+		{false, 13, 1, true},
+		{false, 23, 2, true},
+		{false, 24, 3, false},
+		{true, 8, 0, true},
+		{true, 16, 1, true},
+		{true, 31, 1, true},
+		{true, 32, 2, false},
+	} {
+		filename := filepath.Join(dir, "partial.ts")
+		os.Remove(filename)
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wr := &TimestampFileWriter{WriteCloser: &shortFile{File: f, limit: tc.limit}, name: filename}
+		var n, size int
+		if tc.widths {
+			n, err = wr.AppendPulseWidths(widths)
+			size = 16
+		} else {
+			n, err = wr.AppendBatch(times)
+			size = 8
+		}
+		wr.Close()
+		if got, want := n, tc.written; got != want {
+			t.Errorf("%v: got %v records written, want %v", i, got, want)
+		}
+		if got, want := err != nil, tc.err; got != want {
+			t.Errorf("%v: got error %v, want an error: %v", i, err, want)
+		}
+		// Any partially written record must have been removed.
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.Size(), int64(tc.written*size); got != want {
+			t.Errorf("%v: got file size %v, want %v", i, got, want)
+		}
+		_, recent, err := ReadRecentTimestamps(filename, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tc.widths {
+			for j := range recent {
+				if !recent[j].Equal(times[j]) {
+					t.Errorf("%v: %v: got %v, want %v", i, j, recent[j], times[j])
+				}
+			}
+		}
+	}
+}
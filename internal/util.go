@@ -1,19 +1,82 @@
 package internal
 
-import "time"
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
 
-// UntilHHMM returns the duration until the specified time (in 24 hours and
-// minutes) will be reached.
-func UntilHHMM(hhmm time.Time) time.Duration {
-	now := time.Now().UTC()
+// UntilHHMM returns the duration from now until the specified time (in 24
+// hours and minutes) will next be reached, if now is that time then it
+// will next be reached in 24 hours.
+func UntilHHMM(now, hhmm time.Time) time.Duration {
+	now = now.UTC()
 	then := time.Date(now.Year(), now.Month(), now.Day(), hhmm.UTC().Hour(), hhmm.UTC().Minute(), 0, 0, time.UTC)
 	until := then.Sub(now)
-	if until < 0 {
+	if until <= 0 {
 		until += 24 * time.Hour
 	}
 	return until
 }
 
+// AdjustHHMM returns hhmm with its UTC offset advanced by dst, ie. the
+// same hours and minutes in the corresponding daylight savings time zone.
+func AdjustHHMM(hhmm time.Time, dst time.Duration) time.Time {
+	_, offset := hhmm.Zone()
+	zone := time.FixedZone("", offset+int(dst/time.Second))
+	return time.Date(hhmm.Year(), hhmm.Month(), hhmm.Day(), hhmm.Hour(), hhmm.Minute(), 0, 0, zone)
+}
+
+// UntilHHMMDST is like UntilHHMM except that hhmm is adjusted by dst, as
+// per AdjustHHMM, if daylight savings time is in effect, in now's
+// location, at the time that it is next reached. Hence a time specified
+// in standard time is reached at the same local time all year round.
+func UntilHHMMDST(now, hhmm time.Time, dst time.Duration) time.Duration {
+	var until time.Duration
+	for _, isDST := range []bool{false, true} {
+		at := hhmm
+		if isDST {
+			at = AdjustHHMM(hhmm, dst)
+		}
+		// The time is only reached if daylight savings time is in effect,
+		// or not, as assumed, the next occurrence may be a day later if
+		// there is a transition in between.
+		for d := UntilHHMM(now, at); d <= 48*time.Hour; d += 24 * time.Hour {
+			if now.Add(d).IsDST() == isDST {
+				if until == 0 || d < until {
+					until = d
+				}
+				break
+			}
+		}
+	}
+	return until
+}
+
 func HHMM(hhmm time.Time) string {
 	return hhmm.Format("15:04")
 }
+
+// writeFileDurably writes buf to the specified file by writing and
+// syncing a temporary file and then renaming it.
+func writeFileDurably(filename string, buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %v: %v", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %v: %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
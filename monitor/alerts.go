@@ -0,0 +1,406 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// alertCheckInterval is the longest interval between evaluations of
+// the alert rules.
+const alertCheckInterval = time.Minute
+
+// ruleState is the state of a single alert rule.
+type ruleState struct {
+	rule *internal.AlertRule
+	// whether the rule is an away rule.
+	away bool
+	// time of the previous evaluation.
+	lastCheck time.Time
+	// whether the rule is firing, when it started to fire, when the
+	// most recent notification for it was sent and when it last stopped
+	// firing, which is zero if it is still firing.
+	firing              bool
+	firedAt, notifiedAt time.Time
+	clearedAt           time.Time
+	text                string
+	// the end of the most recent period evaluated by a night_minimum,
+	// baseline, scheduled_usage or lost_pulses rule, the number of
+	// consecutive such periods for which it has exceeded the rule's
+	// limit and a description of the period.
+	periodEnd  time.Time
+	periods    int
+	periodText string
+}
+
+// evaluateRules periodically evaluates all of the meter's alert rules,
+// and its away rules whilst away mode is active, and continuous_run
+// rules as each pulse is counted, and sends notifications as each starts
+// to fire, optionally whilst it continues to fire and once it is
+// resolved. The pulse history, rather than the change in the count, is
+// used so that pulses seen before a restart are included.
+func evaluateRules(ctx context.Context, m *meter, smtp *internal.SMTPClient) {
+	clock := m.clock()
+	started := clock.Now()
+	check := alertCheckInterval
+	states := make([]*ruleState, 0, len(m.config.AlertRules)+len(m.config.AwayRules))
+	for i := range m.config.AlertRules {
+		states = append(states, &ruleState{rule: &m.config.AlertRules[i], lastCheck: started})
+	}
+	for i := range m.config.AwayRules {
+		states = append(states, &ruleState{rule: &m.config.AwayRules[i], away: true, lastCheck: started})
+	}
+	for _, state := range states {
+		if w := state.rule.WindowDuration; w > 0 && w < check {
+			check = w
+		}
+	}
+	timer := clock.After(check)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.pulsed:
+			// Rules that are evaluated as each pulse is counted only
+			// start firing here, they are resolved by the periodic
+			// evaluation below.
+			now := clock.Now()
+			for _, state := range states {
+				if state.rule.Type != internal.ContinuousRunRule || state.firing {
+					continue
+				}
+				since, ok := state.applies(m, started, now)
+				if !ok {
+					continue
+				}
+				if firing, text := state.evaluate(m, since, now); firing {
+					state.update(m, now, firing, text, smtp)
+				}
+			}
+		case <-timer:
+			now := clock.Now()
+			for _, state := range states {
+				firing, text := false, ""
+				if since, ok := state.applies(m, started, now); ok {
+					firing, text = state.evaluate(m, since, now)
+				}
+				state.lastCheck = now
+				state.update(m, now, firing, text, smtp)
+			}
+			// Rearm the timer once the rules have been evaluated so that
+			// a SimulatedClock's Timers indicates that they have been.
+			timer = clock.After(now.Add(check).Sub(clock.Now()))
+		}
+	}
+}
+
+// applies returns true, and the time from which the rule is to be
+// evaluated, if the rule applies at the specified time. Away rules only
+// apply whilst away mode is active and are evaluated from the time at
+// which it became active, similarly rules with except_scheduled set are
+// evaluated from the end of the most recent scheduled period.
+func (state *ruleState) applies(m *meter, started, now time.Time) (time.Time, bool) {
+	if state.away {
+		since, ok := m.monitor.away.since(now)
+		if !ok {
+			return time.Time{}, false
+		}
+		started = since
+	}
+	if state.rule.ExceptScheduled {
+		if m.scheduled(now) {
+			return time.Time{}, false
+		}
+		if end := m.lastScheduledEnd(now); end.After(started) {
+			started = end
+		}
+	}
+	// The between period of night_minimum and scheduled_usage rules
+	// specifies the period to be measured rather than when the rule
+	// applies.
+	switch state.rule.Type {
+	case internal.NightMinimumRule, internal.ScheduledUsageRule:
+		return started, true
+	}
+	return started, state.rule.Active(now)
+}
+
+// update updates the state of the rule given whether it is currently
+// firing and sends any resulting notification.
+func (state *ruleState) update(m *meter, now time.Time, firing bool, text string, smtp *internal.SMTPClient) {
+	rule := state.rule
+	switch {
+	case firing && !state.firing:
+		state.firing, state.firedAt, state.notifiedAt, state.text = true, now, now, text
+		notify(m, rule, "ALERT", now, text, smtp)
+		if rule.Shutoff {
+			m.valve.close(now, fmt.Sprintf("%v: %v", rule.Name, text))
+		}
+	case firing:
+		state.clearedAt, state.text = time.Time{}, text
+		if r := rule.ReminderDuration; r > 0 && now.Sub(state.notifiedAt) >= r {
+			state.notifiedAt = now
+			notify(m, rule, "REMINDER", now, fmt.Sprintf("firing since %v: %v", state.firedAt, text), smtp)
+		}
+	case state.firing:
+		// Only resolve the rule once it has stopped firing for
+		// ResolveAfter to avoid repeated notifications for a condition
+		// that comes and goes.
+		if state.clearedAt.IsZero() {
+			state.clearedAt = now
+		}
+		if now.Sub(state.clearedAt) >= rule.ResolveAfterDuration {
+			state.firing = false
+			notify(m, rule, "RESOLVED", now, fmt.Sprintf("fired from %v to %v: %v", state.firedAt, state.clearedAt, state.text), smtp)
+			state.clearedAt = time.Time{}
+		}
+	}
+}
+
+// evaluate evaluates the rule at the specified time and returns true and
+// a description of the condition if it is firing.
+func (state *ruleState) evaluate(m *meter, started, now time.Time) (bool, string) {
+	rule := state.rule
+	window := rule.WindowDuration
+	switch rule.Type {
+	case internal.RateAboveRule:
+		// Use a sliding window, including any that ended since the
+		// previous evaluation, so that bursts that straddle evaluations
+		// are detected, but only pulses seen since an away or
+		// except_scheduled rule started to apply.
+		since := state.lastCheck.Add(-window)
+		if (state.away || rule.ExceptScheduled) && since.Before(started) {
+			since = started
+		}
+		seen, start, end := m.history.BusiestWindow(since, window)
+		if int64(seen) <= rule.Pulses {
+			return false, ""
+		}
+		return true, fmt.Sprintf("%v over %v: from %v to %v (%v)",
+			m.usage(int64(seen)), window, start, end, m.rate(seen, end.Sub(start)))
+	case internal.RateBelowRule:
+		// Wait for a full window since startup since there may be no
+		// history from before then.
+		if now.Sub(started) < window {
+			return false, ""
+		}
+		seen := int64(m.history.CountSince(now.Add(-window)))
+		if seen >= rule.Pulses {
+			return false, ""
+		}
+		if seen == 0 {
+			return true, fmt.Sprintf("no flow for %v", window)
+		}
+		return true, fmt.Sprintf("%v over %v, below %v", m.usage(seen), window, m.usage(rule.Pulses))
+	case internal.NoIdleRule:
+		if m.history.Idle(now.Add(-window), now, rule.IdleDuration) {
+			return false, ""
+		}
+		return true, fmt.Sprintf("POSSIBLE LEAK: no idle period of %v for %v", rule.IdleDuration, window)
+	case internal.ContinuousRunRule:
+		// The run must still be in progress, or have ended since the
+		// previous evaluation.
+		seen, start, end := m.history.LastRun(rule.IdleDuration)
+		if seen == 0 || (now.Sub(end) >= rule.IdleDuration && end.Before(state.lastCheck)) {
+			return false, ""
+		}
+		volume := m.config.Volume(int64(seen))
+		var exceeded []string
+		if rule.Pulses > 0 && int64(seen) > rule.Pulses {
+			exceeded = append(exceeded, fmt.Sprintf("more than %v", m.usage(rule.Pulses)))
+		}
+		if rule.Volume > 0 && volume > rule.Volume {
+			exceeded = append(exceeded, fmt.Sprintf("more than %v %v", rule.Volume, m.config.Units))
+		}
+		if window > 0 && end.Sub(start) > window {
+			exceeded = append(exceeded, fmt.Sprintf("longer than %v", window))
+		}
+		if len(exceeded) == 0 {
+			return false, ""
+		}
+		return true, fmt.Sprintf("continuous use of %v over %v from %v to %v (%v), %v",
+			m.usage(int64(seen)), end.Sub(start), start, end, m.rate(seen, end.Sub(start)), strings.Join(exceeded, " and "))
+	case internal.NightMinimumRule:
+		start, end := rule.LastPeriod(now)
+		if !end.Equal(state.periodEnd) {
+			state.periodEnd, state.periods = end, 0
+			// Count the consecutive nights, from the pulse history rather
+			// than as each one ends, so that nights before a restart are
+			// included.
+			min := int64(m.history.MinimumCount(start, end, window))
+			for s, e, n := start, end, min; n > rule.Pulses && state.periods < rule.Nights; {
+				state.periods++
+				if s, e = rule.LastPeriod(s); s.Before(now.Add(-m.history.Retention())) {
+					break
+				}
+				n = int64(m.history.MinimumCount(s, e, window))
+			}
+			state.periodText = fmt.Sprintf("POSSIBLE LEAK: minimum flow of %v per %v from %v to %v",
+				m.usage(min), window, start.Format(time.RFC822), end.Format(time.RFC822))
+		}
+		if state.periods < rule.Nights {
+			return false, ""
+		}
+		return true, fmt.Sprintf("%v, above %v for %v consecutive nights", state.periodText, m.usage(rule.Pulses), state.periods)
+	case internal.BaselineRule:
+		end := now.Truncate(time.Hour)
+		start := end.Add(-time.Hour)
+		if !end.Equal(state.periodEnd) {
+			state.periodEnd, state.periods = end, 0
+			mean, stddev, ok := m.expected(start, end)
+			if !ok {
+				return false, ""
+			}
+			seen := int64(m.history.CountSince(start) - m.history.CountSince(end))
+			if z := internal.ZScore(float64(seen), mean, stddev); math.Abs(z) > rule.ZScore {
+				state.periods = 1
+				state.periodText = fmt.Sprintf("UNUSUAL USAGE: %v from %v to %v: %v",
+					m.usage(seen), start.Format("15:04"), end.Format("15:04"), m.baselineReport(seen, start, end))
+			}
+		}
+		if state.periods == 0 {
+			return false, ""
+		}
+		return true, state.periodText
+	case internal.ScheduledUsageRule:
+		start, end := rule.LastPeriod(now)
+		if !end.Equal(state.periodEnd) {
+			state.periodEnd, state.periods = end, 0
+			// Ignore periods that are not covered by the pulse history,
+			// eg. those that ended long before a restart.
+			if start.Before(now.Add(-m.history.Retention())) {
+				return false, ""
+			}
+			seen := int64(m.history.CountSince(start) - m.history.CountSince(end))
+			volume := m.config.Volume(seen)
+			var limit string
+			switch {
+			case rule.MinVolume > 0 && volume < rule.MinVolume:
+				limit = fmt.Sprintf("below the expected minimum of %v %v", rule.MinVolume, m.config.Units)
+			case rule.MaxVolume > 0 && volume > rule.MaxVolume:
+				limit = fmt.Sprintf("above the expected maximum of %v %v", rule.MaxVolume, m.config.Units)
+			default:
+				return false, ""
+			}
+			state.periods = 1
+			state.periodText = fmt.Sprintf("SCHEDULED USAGE: %v from %v to %v, %v",
+				m.usage(seen), start.Format(time.RFC822), end.Format(time.RFC822), limit)
+		}
+		if state.periods == 0 {
+			return false, ""
+		}
+		return true, state.periodText
+	case internal.StuckClosedRule:
+		since, closed := m.stuckSince()
+		if !closed || now.Sub(since) <= window {
+			return false, ""
+		}
+		return true, fmt.Sprintf("SENSOR FAULT: input closed continuously since %v, longer than %v", since, window)
+	case internal.ChatteringRule:
+		seen := int64(m.chatter.CountSince(now.Add(-window)))
+		if seen <= rule.Pulses {
+			return false, ""
+		}
+		return true, fmt.Sprintf("SENSOR FAULT: %v glitches or implausibly short intervals between pulses over %v", seen, window)
+	case internal.LostPulsesRule:
+		end := now.Truncate(time.Hour)
+		start := end.Add(-time.Hour)
+		if !end.Equal(state.periodEnd) {
+			state.periodEnd, state.periods = end, 0
+			min, ok := m.minimum(start)
+			if !ok || min == 0 {
+				return false, ""
+			}
+			if m.history.CountSince(start) == m.history.CountSince(end) {
+				state.periods = 1
+				state.periodText = fmt.Sprintf("SENSOR FAULT: no pulses from %v to %v, previously never less than %v",
+					start.Format("15:04"), end.Format("15:04"), m.usage(int64(min)))
+			}
+		}
+		if state.periods == 0 {
+			return false, ""
+		}
+		return true, state.periodText
+	}
+	return false, ""
+}
+
+// notify sends a notification for a rule to the rule's channels.
+func notify(m *meter, rule *internal.AlertRule, kind string, now time.Time, text string, smtp *internal.SMTPClient) {
+	msg := fmt.Sprintf("%v: %v: %v: %v: %v: %v\n", kind, strings.ToUpper(rule.Severity), m, rule.Name, text, now)
+	if rule.SendTo(internal.ConsoleChannel) {
+		os.Stdout.WriteString(msg)
+	}
+	if rule.SendTo(internal.EmailChannel) {
+		if err := smtp.Alert(msg); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR sending email: %v", err)
+		}
+	}
+}
+
+var dstStr = map[bool]string{
+	true:  "Daylight Savings Time",
+	false: "Standard Time",
+}
+
+func daily(ctx context.Context, clock internal.Clock, meters []*meter, away *away, hhmm time.Time, dstAdjustment time.Duration, smtp *internal.SMTPClient) {
+	// Count usage from the time of the previous daily email, even if
+	// that was before a restart.
+	until := internal.UntilHHMMDST(clock.Now(), hhmm, dstAdjustment)
+	periodStart := clock.Now().Add(until - 24*time.Hour)
+	prev := make([]int64, len(meters))
+	for i, m := range meters {
+		prev[i] = m.count() - int64(m.history.CountSince(periodStart))
+	}
+	for {
+		duration := internal.UntilHHMMDST(clock.Now(), hhmm, dstAdjustment)
+		dst := clock.Now().Add(duration).IsDST()
+		fmt.Printf("next daily email at %v in %v (%v)\n", internal.HHMM(hhmm), duration, dstStr[dst])
+		if !sleep(ctx, clock, duration) {
+			return
+		}
+		// send email
+		now := clock.Now()
+		start := periodStart
+		duration = now.Sub(start)
+		periodStart = now
+		trailer, msg := &strings.Builder{}, &strings.Builder{}
+		for i, m := range meters {
+			cur := m.count()
+			usage := m.usage(cur - prev[i])
+			if i > 0 {
+				trailer.WriteString(",")
+			}
+			fmt.Fprintf(trailer, " %v: %v", m, usage)
+			fmt.Fprintf(msg, "DAILY USAGE: %v: %v over %v @ %v\n",
+				m,
+				usage,
+				duration.Round(time.Minute),
+				now.Format(time.RFC822),
+			)
+			if len(m.config.RegisterFile) > 0 {
+				fmt.Fprintf(msg, "REGISTER: %v: %v\n", m, m.registerReport())
+			}
+			if m.valve != nil {
+				fmt.Fprintf(msg, "SHUTOFF: %v: %v\n", m, m.valve.String())
+			}
+			if m.hasSchedules() {
+				fmt.Fprintf(msg, "SCHEDULED: %v: %v\n", m, m.scheduleReport(start, now))
+			}
+			if m.config.BaselineWeeks > 0 {
+				fmt.Fprintf(msg, "BASELINE: %v: %v\n", m, m.baselineReport(cur-prev[i], start, now))
+			}
+			fmt.Fprintf(msg, "GLITCHES: %v: %v\n", m, m.glitchReport())
+			prev[i] = cur
+		}
+		fmt.Fprintf(msg, "AWAY: %v\n", away.report(start, now))
+		if err := smtp.Status(trailer.String(), msg.String()); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR sending email: %v", err)
+		}
+	}
+}
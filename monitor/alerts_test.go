@@ -0,0 +1,262 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// captureStdout redirects os.Stdout, to which alerts are written, until
+// the returned function is called, that function returns the lines
+// that were written.
+func captureStdout(t *testing.T) func() []string {
+	t.Helper()
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = wr
+	var lines []string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sc := bufio.NewScanner(rd)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+	}()
+	return func() []string {
+		os.Stdout = stdout
+		wr.Close()
+		wg.Wait()
+		rd.Close()
+		return lines
+	}
+}
+
+// waitForTimer waits for a goroutine to block on clock.
+func waitForTimer(t *testing.T, clock *internal.SimulatedClock) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for clock.Timers() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for a timer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	config := readTestConfig(t, dir, `"hardware": "none", "pulse_timestamps_file": "unused.ts",
+"alert_rules": [{"name": "high", "type": "rate_above", "window": "1m", "pulses": 5, "reminder": "5m", "resolve_after": "3m"}]`)
+	start := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	clock := internal.NewSimulatedClock(start)
+	mon, err := New(config, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mon.meters[0]
+
+	lines := captureStdout(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		evaluateRules(ctx, m, nil)
+		close(done)
+	}()
+
+	// Use water at a high rate for the first 6 minutes, the rules are
+	// evaluated at the end of every minute.
+	for minute := 0; minute < 15; minute++ {
+		waitForTimer(t, clock)
+		if minute < 6 {
+			for i := 0; i < 10; i++ {
+				m.pulse(clock.Now().Add(10*time.Second + time.Duration(i)*time.Second))
+			}
+		}
+		clock.Advance(time.Minute)
+	}
+	waitForTimer(t, clock)
+	cancel()
+	<-done
+
+	var got []string
+	for _, line := range lines() {
+		parts := strings.Split(line, ": ")
+		if len(parts) < 2 || parts[1] != "WARNING" {
+			continue
+		}
+		when, err := time.Parse("2006-01-02 15:04:05 -0700 MST", parts[len(parts)-1])
+		if err != nil {
+			t.Fatalf("%v: %v", line, err)
+		}
+		got = append(got, parts[0]+"@"+when.Sub(start).String())
+	}
+	// The rule fires after the first minute, a reminder is sent 5
+	// minutes later and it is resolved once it has not fired for 3
+	// minutes, ie. 3 minutes after the pulses at 5m10s leave the window.
+	want := []string{"ALERT@1m0s", "REMINDER@6m0s", "RESOLVED@11m0s"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRuleStateUpdate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	config := readTestConfig(t, dir, `"hardware": "none", "pulse_timestamps_file": "unused.ts",
+"alert_rules": [{"name": "flapping", "type": "rate_above", "window": "1m", "pulses": 5, "reminder": "5m", "resolve_after": "3m"}]`)
+	mon, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mon.meters[0]
+	state := &ruleState{rule: &m.config.AlertRules[0]}
+	start := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+
+	for i, tc := range []struct {
+		minute         int
+		firing, active bool
+		kind           string
+	}{
+		{0, false, false, ""},
+		{1, true, true, "ALERT"},
+		{3, true, true, ""},
+		{6, true, true, "REMINDER"},
+		// Stops firing briefly, this is not long enough to resolve it.
+		{7, false, true, ""},
+		{9, true, true, ""},
+		{10, false, true, ""},
+		{12, false, true, ""},
+		// 3 minutes after it stopped firing.
+		{13, false, false, "RESOLVED"},
+		{14, false, false, ""},
+		{20, true, true, "ALERT"},
+		{24, true, true, ""},
+		{25, true, true, "REMINDER"},
+		{30, true, true, "REMINDER"},
+	} {
+		now := start.Add(time.Duration(tc.minute) * time.Minute)
+		lines := captureStdout(t)
+		state.update(m, now, tc.firing, "text", nil)
+		got := lines()
+		switch {
+		case len(tc.kind) == 0 && len(got) != 0:
+			t.Errorf("%v: %v: unexpected notification: %v", i, tc.minute, got)
+		case len(tc.kind) > 0 && (len(got) != 1 || !strings.HasPrefix(got[0], tc.kind+": WARNING: ")):
+			t.Errorf("%v: %v: got %v, want a %v notification", i, tc.minute, got, tc.kind)
+		}
+		if got, want := state.firing, tc.active; got != want {
+			t.Errorf("%v: %v: got firing %v, want %v", i, tc.minute, got, want)
+		}
+		if tc.kind == "RESOLVED" && len(got) == 1 {
+			if want := fmt.Sprintf("fired from %v to %v", start.Add(time.Minute), start.Add(10*time.Minute)); !strings.Contains(got[0], want) {
+				t.Errorf("%v: %v: got %v, want %v", i, tc.minute, got[0], want)
+			}
+		}
+	}
+}
+
+func TestStuckClosed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	config := readTestConfig(t, dir, `"hardware": "none", "pulse_timestamps_file": "unused.ts",
+"alert_rules": [{"name": "stuck", "type": "stuck_closed", "window": "5m"}]`)
+	start := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	clock := internal.NewSimulatedClock(start)
+	mon, err := New(config, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mon.meters[0]
+	state := &ruleState{rule: &m.config.AlertRules[0]}
+
+	// The time at which the input closed is taken from the meter's clock.
+	for i, tc := range []struct {
+		advance time.Duration
+		value   byte
+		firing  bool
+	}{
+		{0, 0, false},
+		{time.Minute, 1, false},
+		{4 * time.Minute, 1, false},
+		{time.Minute + time.Second, 1, true},
+		{time.Hour, 1, true},
+		{0, 0, false},
+		{time.Minute, 1, false},
+		{5*time.Minute + time.Second, 1, true},
+	} {
+		clock.Advance(tc.advance)
+		m.sampled(tc.value)
+		if got, _ := state.evaluate(m, start, clock.Now()); got != tc.firing {
+			t.Errorf("%v: %v: got %v, want %v", i, clock.Now().Sub(start), got, tc.firing)
+		}
+	}
+}
+
+func TestNightMinimumRestored(t *testing.T) {
+	// Flow every 5 minutes, all night, for the specified nights before
+	// the 4th of July.
+	night := func(nights ...int) []time.Time {
+		var times []time.Time
+		for _, n := range nights {
+			start := time.Date(2020, 7, 4-n, 1, 0, 0, 0, time.UTC)
+			for i := 0; i < 4*12; i++ {
+				times = append(times, start.Add(time.Duration(i)*5*time.Minute))
+			}
+		}
+		return times
+	}
+	now := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	for i, tc := range []struct {
+		nights int
+		flow   []time.Time
+		firing bool
+	}{
+		{3, night(2, 1, 0), true},
+		{3, night(3, 2, 1, 0), true},
+		{3, night(3, 1, 0), false},
+		{3, night(1, 0), false},
+		{1, night(0), true},
+		{2, night(1), false},
+	} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		filename := filepath.Join(dir, "water.ts")
+		if len(tc.flow) > 0 {
+			writeTimestamps(t, filename, tc.flow)
+		}
+		config := readTestConfig(t, dir, fmt.Sprintf(`"hardware": "none", "pulse_timestamps_file": %q,
+"alert_rules": [{"name": "slow-leak", "type": "night_minimum", "between": "01:00-05:00", "nights": %v}]`, filename, tc.nights))
+		mon, err := New(config, WithClock(internal.NewSimulatedClock(now)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mon.meters[0]
+		// The nights before the restart are restored from the timestamp
+		// file.
+		if err := m.restore(); err != nil {
+			t.Fatal(err)
+		}
+		state := &ruleState{rule: &m.config.AlertRules[0]}
+		firing, text := state.evaluate(m, now, now)
+		if firing != tc.firing {
+			t.Errorf("%v: got %v, want %v", i, firing, tc.firing)
+		}
+		if want := fmt.Sprintf("for %v consecutive nights", tc.nights); firing && !strings.Contains(text, want) {
+			t.Errorf("%v: got %v, want %v", i, text, want)
+		}
+	}
+}
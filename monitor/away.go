@@ -0,0 +1,225 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// awayButtonDebounce is the debounce duration for the away mode button.
+const awayButtonDebounce = 50 * time.Millisecond
+
+// awayInterval is a period of away mode, to is zero if it is ongoing.
+type awayInterval struct {
+	from, to time.Time
+}
+
+// away tracks whether away mode is active. It is active whilst the away
+// option is set, during any scheduled away period or whilst toggled on
+// via the button or API.
+type away struct {
+	config *internal.Configuration
+	// signalled, without blocking, whenever away mode is toggled.
+	changed chan struct{}
+
+	mu      sync.Mutex
+	started time.Time
+	// the periods for which away mode has been toggled on in the last
+	// day or so.
+	toggled []awayInterval
+}
+
+func newAway(config *internal.Configuration) *away {
+	return &away{config: config, changed: make(chan struct{}, 1)}
+}
+
+// start records the time at which monitoring started.
+func (a *away) start(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.started = now
+}
+
+// toggledOn returns true if away mode is currently toggled on, it must
+// be called with mu held.
+func (a *away) toggledOn() bool {
+	n := len(a.toggled)
+	return n > 0 && a.toggled[n-1].to.IsZero()
+}
+
+// set toggles away mode on or off, it returns false if it was already in
+// the requested state.
+func (a *away) set(on bool, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.setLocked(on, now)
+}
+
+func (a *away) setLocked(on bool, now time.Time) bool {
+	if on == a.toggledOn() {
+		return false
+	}
+	if on {
+		a.toggled = append(a.toggled, awayInterval{from: now})
+	} else {
+		a.toggled[len(a.toggled)-1].to = now
+	}
+	// Retain enough history for the daily email.
+	for len(a.toggled) > 0 && !a.toggled[0].to.IsZero() && now.Sub(a.toggled[0].to) > 25*time.Hour {
+		a.toggled = a.toggled[1:]
+	}
+	select {
+	case a.changed <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// toggle toggles away mode and returns its new state.
+func (a *away) toggle(now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	on := !a.toggledOn()
+	a.setLocked(on, now)
+	return on
+}
+
+// intervals returns all of the periods of away mode, which may overlap.
+func (a *away) intervals() []awayInterval {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	intervals := append([]awayInterval(nil), a.toggled...)
+	if a.config.Away {
+		intervals = append(intervals, awayInterval{from: a.started})
+	}
+	for _, p := range a.config.AwaySchedule {
+		intervals = append(intervals, awayInterval{from: p.FromTime, to: p.ToTime})
+	}
+	return intervals
+}
+
+// since returns true, and the time at which it became active, if away
+// mode is active at the specified time. Overlapping or adjoining periods
+// are treated as a single period.
+func (a *away) since(now time.Time) (time.Time, bool) {
+	intervals := a.intervals()
+	var since time.Time
+	for _, iv := range intervals {
+		if now.Before(iv.from) || (!iv.to.IsZero() && !now.Before(iv.to)) {
+			continue
+		}
+		if since.IsZero() || iv.from.Before(since) {
+			since = iv.from
+		}
+	}
+	for extended := !since.IsZero(); extended; {
+		extended = false
+		for _, iv := range intervals {
+			if iv.from.Before(since) && (iv.to.IsZero() || !iv.to.Before(since)) {
+				since, extended = iv.from, true
+			}
+		}
+	}
+	return since, !since.IsZero()
+}
+
+// during returns the total time for which away mode was active between
+// start and end.
+func (a *away) during(start, end time.Time) time.Duration {
+	var clipped []awayInterval
+	for _, iv := range a.intervals() {
+		if iv.to.IsZero() || iv.to.After(end) {
+			iv.to = end
+		}
+		if iv.from.Before(start) {
+			iv.from = start
+		}
+		if iv.to.After(iv.from) {
+			clipped = append(clipped, iv)
+		}
+	}
+	sort.Slice(clipped, func(i, j int) bool { return clipped[i].from.Before(clipped[j].from) })
+	var total time.Duration
+	var covered time.Time
+	for _, iv := range clipped {
+		if iv.from.Before(covered) {
+			iv.from = covered
+		}
+		if iv.to.After(iv.from) {
+			total += iv.to.Sub(iv.from)
+			covered = iv.to
+		}
+	}
+	return total
+}
+
+// report returns a description of whether away mode was active between
+// start and end.
+func (a *away) report(start, end time.Time) string {
+	d := a.during(start, end)
+	if d == 0 {
+		return "not active"
+	}
+	return fmt.Sprintf("active for %v", d.Round(time.Minute))
+}
+
+// watchAway sends a notification whenever away mode starts or ends,
+// whether due to its schedule, button or API.
+func watchAway(ctx context.Context, mon *Monitor, smtp *internal.SMTPClient) {
+	clock := mon.clock
+	since, active := mon.away.since(clock.Now())
+	if active {
+		fmt.Printf("away mode active since %v\n", since)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-mon.away.changed:
+		case <-clock.After(time.Minute):
+		}
+		now := clock.Now()
+		since, ok := mon.away.since(now)
+		if ok == active {
+			continue
+		}
+		active = ok
+		msg := fmt.Sprintf("AWAY: away mode ended: %v\n", now)
+		if active {
+			msg = fmt.Sprintf("AWAY: away mode started at %v: %v\n", since, now)
+		}
+		os.Stdout.WriteString(msg)
+		if err := smtp.Alert(msg); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR sending email: %v", err)
+		}
+	}
+}
+
+// awayButton toggles away mode each time the button connected to input
+// is pressed.
+func awayButton(ctx context.Context, mon *Monitor, input internal.DigitalInput, pin int, interval time.Duration) {
+	fmt.Printf("away mode button on pin %v\n", pin)
+	debouncer, err := internal.NewDebouncer(&internal.MeterConfig{InputDebounceMS: int(awayButtonDebounce / time.Millisecond)})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: away mode button: %v\n", err)
+		return
+	}
+	for sleep(ctx, internal.SystemClock, interval) {
+		for _, ev := range debouncer.Update(time.Now(), input.Value()) {
+			if ev.Type == internal.PulseStarted {
+				on := mon.away.toggle(mon.clock.Now())
+				fmt.Printf("away mode button pressed, away mode toggled %v\n", onOff[on])
+			}
+		}
+	}
+}
+
+var onOff = map[bool]string{
+	true:  "on",
+	false: "off",
+}
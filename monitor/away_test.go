@@ -0,0 +1,80 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+func TestAway(t *testing.T) {
+	at := func(h int) time.Time { return time.Date(2020, 7, 4, h, 0, 0, 0, time.UTC) }
+	config := &internal.Configuration{AwaySchedule: []internal.AwayPeriod{
+		{FromTime: at(2), ToTime: at(6)},
+		{FromTime: at(4), ToTime: at(8)},
+		{FromTime: at(8), ToTime: at(9)},
+		{FromTime: at(16), ToTime: at(18)},
+	}}
+	a := newAway(config)
+	a.start(at(0))
+	// Toggled on within a scheduled period and until after it ends, then
+	// toggled on again at 20:00 and left on.
+	a.set(true, at(17))
+	a.set(false, at(19))
+	a.set(true, at(20))
+
+	for i, tc := range []struct {
+		now    time.Time
+		since  time.Time
+		active bool
+	}{
+		{at(1), time.Time{}, false},
+		{at(2), at(2), true},
+		{at(5), at(2), true},
+		// The overlapping and adjoining periods from 2:00 to 9:00 are
+		// a single period.
+		{at(7), at(2), true},
+		{at(8), at(2), true},
+		{at(9), time.Time{}, false},
+		{at(16), at(16), true},
+		{at(18), at(16), true},
+		{at(19), time.Time{}, false},
+		{at(20), at(20), true},
+		{at(23), at(20), true},
+	} {
+		since, active := a.since(tc.now)
+		if !since.Equal(tc.since) || active != tc.active {
+			t.Errorf("%v: %v: got %v, %v, want %v, %v", i, tc.now, since, active, tc.since, tc.active)
+		}
+	}
+
+	for i, tc := range []struct {
+		start, end time.Time
+		during     time.Duration
+	}{
+		{at(0), at(2), 0},
+		{at(0), at(3), time.Hour},
+		{at(0), at(24), 7*time.Hour + 3*time.Hour + 4*time.Hour},
+		{at(3), at(5), 2 * time.Hour},
+		{at(5), at(7), 2 * time.Hour},
+		{at(7), at(10), 2 * time.Hour},
+		{at(10), at(16), 0},
+		{at(15), at(20), 3 * time.Hour},
+		{at(17), at(18), time.Hour},
+		{at(21), at(22), time.Hour},
+		{at(22), at(22), 0},
+	} {
+		if got, want := a.during(tc.start, tc.end), tc.during; got != want {
+			t.Errorf("%v: %v-%v: got %v, want %v", i, tc.start, tc.end, got, want)
+		}
+	}
+
+	// The away option is active from the time at which monitoring started.
+	config.Away = true
+	if since, active := a.since(at(10)); !since.Equal(at(0)) || !active {
+		t.Errorf("got %v, %v, want %v, true", since, active, at(0))
+	}
+	if got, want := a.during(at(0), at(24)), 24*time.Hour; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
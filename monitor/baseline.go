@@ -0,0 +1,84 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+const (
+	// how often the baseline is rebuilt from the timestamp file.
+	baselineRebuildInterval = 24 * time.Hour
+	// minimum number of samples of an hour of the week needed for the
+	// baseline for that hour to be used.
+	baselineMinSamples = 2
+)
+
+// learnBaseline builds the meter's baseline from its timestamp file and
+// periodically rebuilds it thereafter.
+func learnBaseline(ctx context.Context, m *meter) {
+	clock := m.clock()
+	for {
+		b, err := internal.BuildBaseline(m.config.PulseTimestampFile, clock.Now(), m.config.BaselineWeeks)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v: failed to build baseline: %v\n", m, err)
+		} else {
+			m.baselineMu.Lock()
+			m.baseline = b
+			m.baselineMu.Unlock()
+			if m.verbose() {
+				fmt.Fprintf(os.Stderr, "%v: built baseline from %v weeks\n", m, b.Weeks)
+			}
+		}
+		if !sleep(ctx, clock, baselineRebuildInterval) {
+			return
+		}
+	}
+}
+
+// expected returns the number of pulses expected, according to the
+// meter's baseline, between start and end and the standard deviation
+// thereof. It returns false if there is no baseline or it has too few
+// samples.
+func (m *meter) expected(start, end time.Time) (float64, float64, bool) {
+	m.baselineMu.Lock()
+	b := m.baseline
+	m.baselineMu.Unlock()
+	if b == nil {
+		return 0, 0, false
+	}
+	return b.Expected(start, end, baselineMinSamples)
+}
+
+// minimum returns the minimum number of pulses seen, according to the
+// meter's baseline, in the hour of the week that starts at the specified
+// time. It returns false if there is no baseline or it has too few
+// samples.
+func (m *meter) minimum(start time.Time) (int, bool) {
+	m.baselineMu.Lock()
+	b := m.baseline
+	m.baselineMu.Unlock()
+	if b == nil {
+		return 0, false
+	}
+	how := internal.HourOfWeek(start)
+	if b.Samples[how] < baselineMinSamples {
+		return 0, false
+	}
+	return b.Minimum[how], true
+}
+
+// baselineReport returns a description of the usage between start and
+// end compared to the meter's baseline.
+func (m *meter) baselineReport(pulses int64, start, end time.Time) string {
+	mean, stddev, ok := m.expected(start, end)
+	if !ok {
+		return "not yet available"
+	}
+	upp := m.config.UnitsPerPulse
+	return fmt.Sprintf("expected %.1f ± %.1f %v, actual %v (z-score %.1f)",
+		mean*upp, stddev*upp, m.config.Units, m.usage(pulses), internal.ZScore(float64(pulses), mean, stddev))
+}
@@ -0,0 +1,60 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// LeakTestResult records the outcome of a leak test.
+type LeakTestResult = internal.LeakTestResult
+
+// leakTest runs a leak test for m, ie. it records every pulse seen over
+// the specified duration, during which no water should be used, and
+// then reports whether the test passed and records the result.
+func leakTest(ctx context.Context, m *meter, duration time.Duration, smtp *internal.SMTPClient) {
+	defer atomic.StoreInt32(&m.leakTesting, 0)
+	clock := m.clock()
+	start := clock.Now()
+	fmt.Printf("LEAK TEST: %v: started, no water should be used until %v\n", m, start.Add(duration))
+	if !sleep(ctx, clock, duration) {
+		fmt.Printf("LEAK TEST: %v: abandoned after %v\n", m, clock.Now().Sub(start))
+		return
+	}
+	end := clock.Now()
+	result := &internal.LeakTestResult{
+		Meter:     m.config.Name,
+		Start:     start.Round(0),
+		End:       end.Round(0),
+		Allowance: m.config.LeakTestAllowance,
+	}
+	for _, t := range m.history.Since(start) {
+		if !t.Before(end) {
+			break
+		}
+		result.Pulses = append(result.Pulses, t.Round(0))
+	}
+	result.Passed = int64(len(result.Pulses)) <= result.Allowance
+
+	outcome := map[bool]string{true: "PASSED", false: "FAILED"}[result.Passed]
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "LEAK TEST: %v: %v: %v over %v from %v to %v, allowance %v\n",
+		outcome, m, m.usage(int64(len(result.Pulses))), duration, start.Format(time.RFC822), end.Format(time.RFC822), m.usage(result.Allowance))
+	for _, t := range result.Pulses {
+		fmt.Fprintf(msg, "PULSE: %v: %v\n", m, t)
+	}
+	os.Stdout.WriteString(msg.String())
+	if err := smtp.Status(fmt.Sprintf(" leak test %v: %v", strings.ToLower(outcome), m), msg.String()); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR sending email: %v", err)
+	}
+	if filename := m.config.LeakTestFile; len(filename) > 0 {
+		if err := internal.AppendLeakTestResult(filename, result); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v: failed to record leak test result: %v\n", m, err)
+		}
+	}
+}
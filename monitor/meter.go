@@ -0,0 +1,281 @@
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// meter represents the runtime state of a single meter.
+type meter struct {
+	// number of pulses since start, the number of rejected glitches,
+	// by hour of day, since the last call to glitchReport and the time,
+	// in nanoseconds, at which the raw input closed if it is currently
+	// closed. These must be the first fields to ensure 64 bit alignment
+	// for atomic access on 32 bit platforms.
+	counter     int64
+	glitches    [24]int64
+	closedSince int64
+	// queues pulse timestamps and widths for persistence without ever
+	// blocking the detection of pulses.
+	pipeline *pipeline
+	// the times of recent pulses.
+	history *internal.PulseHistory
+	// the times of recent glitches and implausibly short intervals
+	// between pulses.
+	chatter *internal.PulseHistory
+	// signalled, without blocking, whenever a pulse is counted.
+	pulsed chan struct{}
+
+	// the most recent reading of the physical register, if any, and the
+	// modification time of the file it was read from.
+	registerMu     sync.Mutex
+	anchor         *internal.RegisterAnchor
+	anchorModified time.Time
+
+	// the baseline learnt from the timestamp file, if any.
+	baselineMu sync.Mutex
+	baseline   *internal.Baseline
+
+	// the meter's shut-off valve, if any.
+	valve *valve
+	// set whilst a leak test is running.
+	leakTesting int32
+
+	config  *internal.MeterConfig
+	monitor *Monitor
+}
+
+func newMeter(monitor *Monitor, config *internal.MeterConfig) *meter {
+	// Retain enough history for the daily email and all alerts.
+	retention, chatter := 25*time.Hour, time.Duration(0)
+	for _, rule := range config.AllRules() {
+		if d := rule.Retention(); d > retention {
+			retention = d
+		}
+		if rule.Type == internal.ChatteringRule && rule.WindowDuration > chatter {
+			chatter = rule.WindowDuration
+		}
+	}
+	return &meter{
+		config:   config,
+		monitor:  monitor,
+		pipeline: newPipeline(),
+		history:  internal.NewPulseHistory(retention),
+		chatter:  internal.NewPulseHistory(chatter),
+		pulsed:   make(chan struct{}, 1),
+	}
+}
+
+// count returns the number of pulses seen since start.
+func (m *meter) count() int64 {
+	return atomic.LoadInt64(&m.counter)
+}
+
+// pulse records a pulse that occurred at the specified time.
+func (m *meter) pulse(when time.Time) {
+	if min := m.config.MinPulseInterval(); min > 0 {
+		if prev := m.history.Last(); !prev.IsZero() && when.Sub(prev) < min {
+			m.chatter.Add(when)
+		}
+	}
+	m.history.Add(when)
+	count := atomic.AddInt64(&m.counter, 1)
+	m.pipeline.pushTime(when)
+	select {
+	case m.pulsed <- struct{}{}:
+	default:
+	}
+	m.monitor.publish(PulseEvent{Meter: m.config.Name, Time: when, Count: count})
+}
+
+// restore recovers the total pulse count and recent pulse history from
+// the meter's timestamp file so that they continue across restarts. Any
+// history retained from a previous Start of the same Monitor is replaced
+// since it is also recorded in the timestamp file.
+func (m *meter) restore() error {
+	total, recent, err := internal.ReadRecentTimestamps(m.config.PulseTimestampFile, m.clock().Now().Add(-m.history.Retention()))
+	if err != nil {
+		return err
+	}
+	m.history.Reset()
+	for _, t := range recent {
+		m.history.Add(t)
+	}
+	atomic.StoreInt64(&m.counter, total)
+	fmt.Printf("%v: restored %v pulses, %v in the last %v\n", m, total, len(recent), m.history.Retention())
+	return nil
+}
+
+// initRegister creates the meter's register file, from the configured
+// initial reading, if it does not already exist.
+func (m *meter) initRegister() error {
+	filename := m.config.RegisterFile
+	if len(filename) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(filename); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	anchor, err := m.config.InitialRegisterAnchor()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v: creating %v with an initial register of %v @ %v\n", m, filename, anchor.Reading, anchor.Time)
+	return internal.WriteRegisterAnchor(filename, anchor)
+}
+
+// register returns the current value of the meter's register, it
+// rereads the register file if it has been changed, eg. to resync the
+// register with the physical meter.
+func (m *meter) register() (float64, error) {
+	filename := m.config.RegisterFile
+	if len(filename) == 0 {
+		return 0, fmt.Errorf("no register_file configured")
+	}
+	m.registerMu.Lock()
+	defer m.registerMu.Unlock()
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	if m.anchor == nil || !fi.ModTime().Equal(m.anchorModified) {
+		anchor, err := internal.ReadRegisterAnchor(filename)
+		if err != nil {
+			return 0, err
+		}
+		m.anchor, m.anchorModified = anchor, fi.ModTime()
+	}
+	return m.anchor.Register(m.count(), m.config.UnitsPerPulse), nil
+}
+
+// registerReport returns a description of the meter's register.
+func (m *meter) registerReport() string {
+	reading, err := m.register()
+	if err != nil {
+		return fmt.Sprintf("unavailable: %v", err)
+	}
+	return fmt.Sprintf("%.1f %v", reading, m.config.Units)
+}
+
+// closed records the rising and falling edge times of a pulse that
+// has already been counted.
+func (m *meter) closed(rising, falling time.Time) {
+	if len(m.config.PulseWidthsFile) == 0 {
+		return
+	}
+	m.pipeline.pushWidth(internal.PulseWidth{Rising: rising, Falling: falling})
+}
+
+// debounced handles the events returned by a Debouncer, if midpoint is
+// true pulses are timestamped with the midpoint of the interval within
+// which the circuit closed.
+func (m *meter) debounced(events []internal.DebounceEvent, midpoint bool) {
+	for _, ev := range events {
+		rising := ev.Rising
+		if midpoint {
+			rising = rising.Add(-ev.Uncertainty / 2)
+		}
+		switch ev.Type {
+		case internal.PulseStarted:
+			if m.verbose() {
+				fmt.Fprintf(os.Stderr, "%v: pulse at %v, counted %v later, uncertainty %v\n", m, rising, time.Since(rising), ev.Uncertainty)
+			}
+			m.pulse(rising)
+		case internal.PulseEnded:
+			m.closed(rising, ev.Falling)
+		case internal.GlitchRejected:
+			if m.verbose() {
+				fmt.Fprintf(os.Stderr, "%v: glitch rejected at %v\n", m, rising)
+			}
+			atomic.AddInt64(&m.glitches[rising.Hour()], 1)
+			m.chatter.Add(rising)
+		}
+	}
+}
+
+// sampled records the raw value of the input, before debouncing, so that
+// an input that closes and remains closed is detected whether or not it
+// is ever counted as a pulse. The time at which it closed is taken from
+// the meter's clock, against which the stuck_closed rule is evaluated.
+// An input that is already closed when first sampled, eg. following a
+// restart, is treated as having closed then.
+func (m *meter) sampled(value byte) {
+	if value == 0 {
+		atomic.StoreInt64(&m.closedSince, 0)
+		return
+	}
+	atomic.CompareAndSwapInt64(&m.closedSince, 0, m.clock().Now().UnixNano())
+}
+
+// stuckSince returns the time at which the input closed if it is
+// currently closed.
+func (m *meter) stuckSince() (time.Time, bool) {
+	ns := atomic.LoadInt64(&m.closedSince)
+	if ns == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// glitchReport returns a summary of the glitches rejected, per hour of
+// day, since it was last called.
+func (m *meter) glitchReport() string {
+	var total int64
+	var hours []string
+	for h := range m.glitches {
+		if n := atomic.SwapInt64(&m.glitches[h], 0); n > 0 {
+			total += n
+			hours = append(hours, fmt.Sprintf("%02d:00 %v", h, n))
+		}
+	}
+	if total == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%v (%v)", total, strings.Join(hours, ", "))
+}
+
+func (m *meter) debounceDescription() string {
+	cfg := m.config
+	switch cfg.Debounce {
+	case internal.MinIntervalDebounce:
+		return fmt.Sprintf("%v %v", cfg.Debounce, cfg.MinPulseInterval())
+	case "":
+		return fmt.Sprintf("%v %vms", internal.CounterDebounce, cfg.InputDebounceMS)
+	}
+	return fmt.Sprintf("%v %vms", cfg.Debounce, cfg.InputDebounceMS)
+}
+
+// usage returns a description of the usage represented by the specified
+// number of pulses, eg. "20 gallons".
+func (m *meter) usage(pulses int64) string {
+	return fmt.Sprintf("%v %v", internal.FormatVolume(m.config.Volume(pulses)), m.config.Units)
+}
+
+// rate returns a description of the flow rate represented by the
+// specified number of consecutive pulses spanning the specified period,
+// eg. "2.5 gallons/min".
+func (m *meter) rate(pulses int, period time.Duration) string {
+	if pulses < 2 || period <= 0 {
+		return fmt.Sprintf("unknown %v/min", m.config.Units)
+	}
+	units := float64(pulses-1) * m.config.UnitsPerPulse
+	return fmt.Sprintf("%.1f %v/min", units/period.Minutes(), m.config.Units)
+}
+
+func (m *meter) clock() internal.Clock {
+	return m.monitor.clock
+}
+
+func (m *meter) verbose() bool {
+	return m.monitor.verbose
+}
+
+func (m *meter) String() string {
+	return m.config.Name
+}
@@ -0,0 +1,637 @@
+// Package monitor provides an embeddable pulse monitor that counts the
+// pulses generated by one or more meters, persists them, forwards them
+// to relays or outputs and sends alert and status emails.
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// Configuration represents the configuration of a Monitor.
+type Configuration = internal.Configuration
+
+// MeterConfig represents the configuration of a single meter.
+type MeterConfig = internal.MeterConfig
+
+// Board represents the I/O hardware used by a Monitor.
+type Board = internal.Board
+
+// Clock provides the current time and timers used by a Monitor's time
+// based logic, ie. alerts and the daily status email.
+type Clock = internal.Clock
+
+// SimulatedClock is a Clock that only changes when advanced, it allows
+// days of flow to be simulated in a test without waiting for them.
+type SimulatedClock = internal.SimulatedClock
+
+// NewSimulatedClock creates a SimulatedClock set to the specified time.
+func NewSimulatedClock(now time.Time) *SimulatedClock {
+	return internal.NewSimulatedClock(now)
+}
+
+// ReadConfig reads a Configuration from the specified file.
+func ReadConfig(filename string, config *Configuration) error {
+	return internal.ReadConfig(filename, config)
+}
+
+// PulseEvent is sent to subscribers for every pulse that is counted.
+type PulseEvent struct {
+	// Meter is the name of the meter that the pulse was counted for.
+	Meter string
+	// Time is the time of the pulse.
+	Time time.Time
+	// Count is the meter's total number of pulses, including this one.
+	Count int64
+}
+
+// Option represents an option to New.
+type Option func(*Monitor)
+
+// WithVerbose controls whether debug/trace information is written to
+// stderr.
+func WithVerbose(v bool) Option {
+	return func(mon *Monitor) {
+		mon.verbose = v
+	}
+}
+
+// WithBoard specifies the Board to use rather than creating the one
+// specified by the Configuration. The caller remains responsible for
+// closing the Board.
+func WithBoard(board Board) Option {
+	return func(mon *Monitor) {
+		mon.board = board
+	}
+}
+
+// WithClock specifies the Clock to use for alerts and the daily status
+// email. It defaults to the system clock, or, if the meters replay
+// timestamp files, to a SimulatedClock that runs at the replay speed
+// until the replay is finished and in real time thereafter. A Clock
+// specified by WithClock is used as is for replays.
+func WithClock(clock Clock) Option {
+	return func(mon *Monitor) {
+		mon.clock = clock
+	}
+}
+
+// Monitor monitors the meters specified in its Configuration. It is
+// created by New, runs from a call to Start until a call to Stop and
+// multiple Monitors may be run concurrently provided that they use
+// different files.
+type Monitor struct {
+	config    *Configuration
+	verbose   bool
+	clock     Clock
+	board     Board
+	ownsBoard bool
+	meters    []*meter
+	away      *away
+
+	// the speed at which clock is advanced whilst replaying, if it is
+	// a SimulatedClock created for replaying.
+	replaySpeed float64
+
+	subscribersMu sync.RWMutex
+	subscribers   map[int]chan<- PulseEvent
+	nextID        int
+
+	mu      sync.Mutex
+	started bool
+	ctx     context.Context
+	smtp    *internal.SMTPClient
+	closers []io.Closer
+	// The goroutines that detect pulses and generate alerts run until
+	// stop is called. The output goroutines, which persist and forward
+	// pulses, run until all of the detectors have finished and then
+	// flush any pending output unless abort is called.
+	stop, abort        context.CancelFunc
+	detectors, outputs sync.WaitGroup
+}
+
+// New creates a new Monitor for the specified configuration, which must
+// have been read by ReadConfig.
+func New(config *Configuration, opts ...Option) (*Monitor, error) {
+	if len(config.Meters) == 0 {
+		return nil, fmt.Errorf("no meters are configured")
+	}
+	mon := &Monitor{
+		config:      config,
+		subscribers: map[int]chan<- PulseEvent{},
+		away:        newAway(config),
+	}
+	for _, fn := range opts {
+		fn(mon)
+	}
+	if mon.clock == nil {
+		mon.clock = internal.SystemClock
+		// ReadConfig ensures that either all or none of the meters
+		// replay and that they all replay at the same speed.
+		if cfg := &config.Meters[0]; cfg.InputBackend == internal.ReplayInputBackend {
+			mon.clock = internal.NewSimulatedClock(time.Now())
+			mon.replaySpeed = cfg.ReplaySpeed
+		}
+	}
+	mon.meters = make([]*meter, len(config.Meters))
+	for i := range config.Meters {
+		mon.meters[i] = newMeter(mon, &config.Meters[i])
+	}
+	return mon, nil
+}
+
+// Start starts monitoring all of the configured meters, it returns once
+// monitoring has started. Monitoring continues until Stop is called or
+// ctx is cancelled.
+func (mon *Monitor) Start(ctx context.Context) error {
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	if mon.started {
+		return fmt.Errorf("monitor has already been started")
+	}
+	ctx, stop := context.WithCancel(ctx)
+	flush, startFlush := context.WithCancel(context.Background())
+	abortCtx, abort := context.WithCancel(context.Background())
+	err := mon.start(ctx, flush, abortCtx)
+	// Flush the output once all of the detectors have finished, however
+	// they come to be stopped.
+	go func() {
+		<-ctx.Done()
+		mon.detectors.Wait()
+		startFlush()
+	}()
+	if err != nil {
+		stop()
+		abort()
+		mon.detectors.Wait()
+		mon.outputs.Wait()
+		mon.close()
+		return err
+	}
+	mon.started, mon.ctx, mon.stop, mon.abort = true, ctx, stop, abort
+	return nil
+}
+
+func (mon *Monitor) start(ctx, flush, abort context.Context) error {
+	config := mon.config
+	pollingInterval := time.Duration(config.PollingInterval) * time.Millisecond
+
+	smtpClient, err := config.ConfigureEmail(true)
+	if err != nil {
+		return err
+	}
+	if smtpClient == nil {
+		fmt.Printf("email alerts are not configured")
+	}
+	mon.smtp = smtpClient
+
+	// Create and initialize the I/O hardware.
+	if mon.board == nil {
+		board, err := internal.NewBoard(config)
+		if err != nil {
+			return fmt.Errorf("failed to init board: %v", err)
+		}
+		mon.board, mon.ownsBoard = board, true
+	}
+	board := mon.board
+
+	// Track, and toggle, away mode.
+	mon.away.start(mon.clock.Now())
+	mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) { watchAway(ctx, mon, smtpClient) })
+	if config.AwayButtonPin >= 0 {
+		button, err := board.Input(config.AwayButtonPin)
+		if err != nil {
+			return fmt.Errorf("away mode button: %v", err)
+		}
+		mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) {
+			awayButton(ctx, mon, button, config.AwayButtonPin, pollingInterval)
+		})
+	}
+
+	// All replays start at the same time and, if the clock was created
+	// for them, it runs at the replay speed until they are all finished.
+	replayStart := mon.clock.Now()
+	var replays sync.WaitGroup
+
+	for i := range mon.meters {
+		m := mon.meters[i]
+		cfg := m.config
+		relayHold := time.Duration(cfg.OutputRelayHoldMS) * time.Millisecond
+		switchHold := time.Duration(cfg.OutputPinHoldMS) * time.Millisecond
+
+		// Restore the count and recent history before any new pulses
+		// are appended to the timestamp file.
+		if err := m.restore(); err != nil {
+			return fmt.Errorf("%v: %v", m, err)
+		}
+		// Forward every pulse counted from now on, including any that are
+		// counted before the forwarding goroutines are running.
+		restored := m.count()
+		if err := m.initRegister(); err != nil {
+			return fmt.Errorf("%v: %v", m, err)
+		}
+
+		timestampWriter, err := internal.NewTimestampFileWriter(cfg.PulseTimestampFile)
+		if err != nil {
+			return fmt.Errorf("%v: %v", m, err)
+		}
+		mon.closers = append(mon.closers, &closer{m, cfg.PulseTimestampFile, timestampWriter})
+
+		var widthsWriter *internal.TimestampFileWriter
+		if len(cfg.PulseWidthsFile) > 0 {
+			widthsWriter, err = internal.NewTimestampFileWriter(cfg.PulseWidthsFile)
+			if err != nil {
+				return fmt.Errorf("%v: %v", m, err)
+			}
+			mon.closers = append(mon.closers, &closer{m, cfg.PulseWidthsFile, widthsWriter})
+		}
+
+		// Append to the timestamp and pulse width files independently of
+		// pulse detection and alert if pulses are dropped or delayed.
+		mon.goroutine(flush, &mon.outputs, func(ctx context.Context) { persist(ctx, m, timestampWriter, widthsWriter) })
+		mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) { monitorPipeline(ctx, m, smtpClient) })
+
+		// Log to console, only the first meter is displayed on the LEDs.
+		var leds internal.LEDBank
+		if i == 0 {
+			leds = board.LEDs()
+		}
+		mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) { console(ctx, m, leds) })
+
+		// Learn the meter's typical usage.
+		if cfg.BaselineWeeks > 0 {
+			mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) { learnBaseline(ctx, m) })
+		}
+
+		// Close the meter's shut-off valve when selected rules fire.
+		if cfg.Shutoff() {
+			relay, err := board.Relay(cfg.ShutoffRelayPin)
+			if err != nil {
+				return fmt.Errorf("%v: %v", m, err)
+			}
+			if m.valve, err = newValve(m, relay, smtpClient); err != nil {
+				return fmt.Errorf("%v: %v", m, err)
+			}
+		}
+
+		// Generate alerts as specified by the meter's alert rules.
+		mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) { evaluateRules(ctx, m, smtpClient) })
+
+		if cfg.InputBackend == internal.ReplayInputBackend {
+			// Replay previously recorded pulses.
+			if cfg.ReplayFile == cfg.PulseTimestampFile {
+				return fmt.Errorf("%v: cannot replay the timestamp file being written to: %v", m, cfg.ReplayFile)
+			}
+			replayer := internal.NewTimestampReplayer(cfg.ReplayFile)
+			replays.Add(1)
+			mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) {
+				defer replays.Done()
+				replay(ctx, m, replayer, replayStart)
+			})
+		} else {
+			input, err := internal.NewInput(cfg, board)
+			if err != nil {
+				return fmt.Errorf("%v: %v", m, err)
+			}
+			if c, ok := input.(io.Closer); ok {
+				mon.closers = append(mon.closers, c)
+			}
+			debouncer, err := internal.NewDebouncer(cfg)
+			if err != nil {
+				return fmt.Errorf("%v: %v", m, err)
+			}
+			// Detect pulses using edge events if the input supports them, or
+			// fall back to polling otherwise.
+			if es, ok := input.(internal.EdgeSource); ok {
+				edges := es.Edges()
+				mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) { detect(ctx, m, input, edges, debouncer) })
+			} else {
+				mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) {
+					poll(ctx, m, input, cfg.InputPin, pollingInterval, debouncer, cfg.PulseTimestampMidpoint)
+				})
+			}
+		}
+
+		if cfg.OutputRelayPin >= 0 {
+			relay, err := board.Relay(cfg.OutputRelayPin)
+			if err != nil {
+				return fmt.Errorf("%v: %v", m, err)
+			}
+			mon.goroutine(flush, &mon.outputs, func(ctx context.Context) {
+				forwardRelay(ctx, abort, m, restored, relay, 100*time.Millisecond, cfg.OutputRelayPin, relayHold)
+			})
+		}
+
+		if cfg.OutputPin >= 0 {
+			output, err := board.Output(cfg.OutputPin)
+			if err != nil {
+				return fmt.Errorf("%v: %v", m, err)
+			}
+			mon.goroutine(flush, &mon.outputs, func(ctx context.Context) {
+				forwardSwitch(ctx, abort, m, restored, output, 100*time.Millisecond, cfg.OutputPin, switchHold)
+			})
+		}
+	}
+
+	if clock, ok := mon.clock.(*internal.SimulatedClock); ok && mon.replaySpeed > 0 {
+		replayed := make(chan struct{})
+		go func() {
+			replays.Wait()
+			close(replayed)
+		}()
+		mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) { driveClock(ctx, clock, mon.replaySpeed, replayed) })
+	}
+
+	// Send a daily email.
+	mon.goroutine(ctx, &mon.detectors, func(ctx context.Context) {
+		daily(ctx, mon.clock, mon.meters, mon.away, config.StatusTime, config.DSTAdjustmentDuration, smtpClient)
+	})
+	return nil
+}
+
+// Stop stops monitoring. It stops detecting pulses, waits for all
+// pulses detected so far to be persisted and forwarded, sends a stopped
+// email if configured to do so and then closes all files and hardware.
+// If ctx is cancelled before all pulses are forwarded the remainder are
+// abandoned and ctx.Err() is returned.
+func (mon *Monitor) Stop(ctx context.Context) error {
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	if !mon.started {
+		return fmt.Errorf("monitor is not running")
+	}
+	mon.started = false
+	mon.stop()
+	done := make(chan struct{})
+	go func() {
+		mon.detectors.Wait()
+		mon.outputs.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		mon.abort()
+		<-done
+	}
+	mon.abort()
+	mon.stopped(err)
+	mon.close()
+	return err
+}
+
+// stopped reports that the monitor has stopped and optionally sends
+// a stopped email.
+func (mon *Monitor) stopped(stopErr error) {
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "%v stopped @ %v\n", os.Args[0], mon.clock.Now())
+	for _, m := range mon.meters {
+		fmt.Fprintf(msg, "TOTAL: %v: %v pulses, %v, %v dropped\n",
+			m, m.count(), m.usage(m.count()), atomic.LoadInt64(&m.pipeline.dropped))
+	}
+	if stopErr != nil {
+		fmt.Fprintf(msg, "ERROR: not all pulses were forwarded: %v\n", stopErr)
+	}
+	os.Stdout.WriteString(msg.String())
+	if !mon.config.StoppedEmail {
+		return
+	}
+	if err := mon.smtp.Status(" stopped", msg.String()); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR sending email: %v", err)
+	}
+}
+
+func (mon *Monitor) goroutine(ctx context.Context, wg *sync.WaitGroup, fn func(context.Context)) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fn(ctx)
+	}()
+}
+
+func (mon *Monitor) close() {
+	for i := len(mon.closers) - 1; i >= 0; i-- {
+		mon.closers[i].Close()
+	}
+	mon.closers = nil
+	if mon.ownsBoard {
+		mon.board.Close()
+		mon.board, mon.ownsBoard = nil, false
+	}
+}
+
+// closer logs the closing of a meter's files.
+type closer struct {
+	m        *meter
+	filename string
+	io.Closer
+}
+
+func (c *closer) Close() error {
+	fmt.Printf("%v: closing %v\n", c.m, c.filename)
+	return c.Closer.Close()
+}
+
+// Subscribe registers a channel on which a PulseEvent will be sent for
+// every pulse counted by any meter. Pulse detection never blocks on a
+// subscriber, events are dropped if the channel is full. The returned
+// function cancels the subscription.
+func (mon *Monitor) Subscribe(ch chan<- PulseEvent) (unsubscribe func()) {
+	mon.subscribersMu.Lock()
+	defer mon.subscribersMu.Unlock()
+	id := mon.nextID
+	mon.nextID++
+	mon.subscribers[id] = ch
+	return func() {
+		mon.subscribersMu.Lock()
+		defer mon.subscribersMu.Unlock()
+		delete(mon.subscribers, id)
+	}
+}
+
+func (mon *Monitor) publish(ev PulseEvent) {
+	mon.subscribersMu.RLock()
+	defer mon.subscribersMu.RUnlock()
+	for _, ch := range mon.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Meters returns the names of the monitored meters.
+func (mon *Monitor) Meters() []string {
+	names := make([]string, len(mon.meters))
+	for i, m := range mon.meters {
+		names[i] = m.config.Name
+	}
+	return names
+}
+
+func (mon *Monitor) meter(name string) (*meter, error) {
+	for _, m := range mon.meters {
+		if m.config.Name == name {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("no such meter: %q", name)
+}
+
+// Count returns the total number of pulses counted for the named meter,
+// including those recorded before the Monitor was started.
+func (mon *Monitor) Count(name string) (int64, error) {
+	m, err := mon.meter(name)
+	if err != nil {
+		return 0, err
+	}
+	return m.count(), nil
+}
+
+// CountSince returns the number of pulses counted for the named meter
+// at or after the specified time, which must be within the retained
+// pulse history.
+func (mon *Monitor) CountSince(name string, when time.Time) (int64, error) {
+	m, err := mon.meter(name)
+	if err != nil {
+		return 0, err
+	}
+	return int64(m.history.CountSince(when)), nil
+}
+
+// Pulse records a pulse for the named meter as if it had been detected
+// at the specified time, eg. to feed pulses from another source or to
+// simulate flow in a test.
+func (mon *Monitor) Pulse(name string, when time.Time) error {
+	m, err := mon.meter(name)
+	if err != nil {
+		return err
+	}
+	m.pulse(when)
+	return nil
+}
+
+// Register returns the current register of the named meter, it
+// requires that the meter have a register_file.
+func (mon *Monitor) Register(name string) (float64, error) {
+	m, err := mon.meter(name)
+	if err != nil {
+		return 0, err
+	}
+	return m.register()
+}
+
+// StartLeakTest starts a leak test for the named meter, no water should
+// be used whilst it runs. The test lasts for the specified duration, or
+// the meter's leak_test_duration if zero, and passes if no more than the
+// meter's leak_test_allowance pulses are seen. The result is sent as a
+// status email and recorded in the meter's leak_test_file, if any.
+func (mon *Monitor) StartLeakTest(name string, duration time.Duration) error {
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	m, err := mon.meter(name)
+	if err != nil {
+		return err
+	}
+	if !mon.started || mon.ctx.Err() != nil {
+		return fmt.Errorf("monitor is not running")
+	}
+	if duration == 0 {
+		duration = m.config.LeakTestDefaultDuration
+	}
+	if duration <= 0 || duration > m.history.Retention() {
+		return fmt.Errorf("%v: leak test duration %v must be positive and no more than %v", m, duration, m.history.Retention())
+	}
+	if !atomic.CompareAndSwapInt32(&m.leakTesting, 0, 1) {
+		return fmt.Errorf("%v: a leak test is already running", m)
+	}
+	mon.goroutine(mon.ctx, &mon.detectors, func(ctx context.Context) { leakTest(ctx, m, duration, mon.smtp) })
+	return nil
+}
+
+// LeakTestResults returns the results of all of the leak tests recorded
+// in the named meter's leak_test_file.
+func (mon *Monitor) LeakTestResults(name string) ([]LeakTestResult, error) {
+	m, err := mon.meter(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.config.LeakTestFile) == 0 {
+		return nil, fmt.Errorf("%v: no leak_test_file is configured", m)
+	}
+	return internal.ReadLeakTestResults(m.config.LeakTestFile)
+}
+
+// SetAway turns away mode on or off. Away mode is also active whilst
+// the away option is set and during any scheduled away periods
+// regardless of this setting.
+func (mon *Monitor) SetAway(on bool) {
+	mon.away.set(on, mon.clock.Now())
+}
+
+// Away returns true if away mode is currently active.
+func (mon *Monitor) Away() bool {
+	_, active := mon.away.since(mon.clock.Now())
+	return active
+}
+
+// ResetShutoff reopens the named meter's shut-off valve once it has
+// been closed by an alert rule, the valve remains closed until then.
+func (mon *Monitor) ResetShutoff(name string) error {
+	mon.mu.Lock()
+	m, err := mon.meter(name)
+	var v *valve
+	switch {
+	case err != nil:
+	case !mon.started:
+		err = fmt.Errorf("monitor is not running")
+	case m.valve == nil:
+		err = fmt.Errorf("%v: no shut-off valve is configured", m)
+	default:
+		v = m.valve
+	}
+	mon.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// The valve is reset, and the notification sent, without holding
+	// mu.
+	return v.reset(mon.clock.Now())
+}
+
+// Shutoff returns true, and the reason it was closed, if the named
+// meter's shut-off valve is closed.
+func (mon *Monitor) Shutoff(name string) (bool, string, error) {
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	m, err := mon.meter(name)
+	if err != nil {
+		return false, "", err
+	}
+	if m.valve == nil {
+		return false, "", fmt.Errorf("%v: no shut-off valve is configured", m)
+	}
+	closed, reason := m.valve.status()
+	return closed, reason, nil
+}
+
+// sleep sleeps for the specified duration as measured by clock, it
+// returns false if ctx is cancelled first.
+func sleep(ctx context.Context, clock Clock, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-clock.After(d):
+		return true
+	}
+}
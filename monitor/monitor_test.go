@@ -0,0 +1,175 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// readTestConfig writes the JSON configuration, cfg, to dir and reads it
+// using ReadConfig. The options required by ReadConfig are supplied if
+// cfg does not specify them.
+func readTestConfig(t *testing.T, dir, cfg string) *Configuration {
+	t.Helper()
+	filename := filepath.Join(dir, "config.json")
+	defaults := `"status_email_time": "07:00 -0700", "daylight_savings_adjustment": "1h",
+"alert_interval": "1m", "idle_alert_interval": "10m", "leak_alert_interval": "1h", "alert_pulses": 100,
+"gallons_per_pulse": 10, "input_pin": -1, "relay_pin": -1, "output_pin": -1`
+	if err := ioutil.WriteFile(filename, []byte("{"+defaults+", "+cfg+"}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var config Configuration
+	if err := ReadConfig(filename, &config); err != nil {
+		t.Fatal(err)
+	}
+	return &config
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pulsemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func newTestMonitor(t *testing.T, board Board, dir, name string, pin int, extra string) *Monitor {
+	t.Helper()
+	config := readTestConfig(t, dir, fmt.Sprintf(`"name": %q, "hardware": "simulated",
+"input_pin": %v, "input_debounce_ms": 1, "pulse_timestamps_file": %q%v`,
+		name, pin, filepath.Join(dir, name+".ts"), extra))
+	mon, err := New(config, WithBoard(board))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mon
+}
+
+func readTestTimestamps(t *testing.T, filename string) []time.Time {
+	t.Helper()
+	_, times, err := internal.ReadRecentTimestamps(filename, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return times
+}
+
+func TestMultipleMonitors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	board := internal.NewSimulatedBoard(nil, false)
+	defer board.Close()
+
+	names := []string{"main", "irrigation"}
+	var mons []*Monitor
+	var chs []chan PulseEvent
+	for i, name := range names {
+		mon := newTestMonitor(t, board, filepath.Join(dir), name, i, "")
+		ch := make(chan PulseEvent, 100)
+		defer mon.Subscribe(ch)()
+		if err := mon.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		mons, chs = append(mons, mon), append(chs, ch)
+	}
+
+	// Close each input once more often than the previous one.
+	for i := range mons {
+		for p := 0; p <= i; p++ {
+			board.SetInput(i, 1)
+			select {
+			case ev := <-chs[i]:
+				if got, want := ev.Meter, names[i]; got != want {
+					t.Errorf("got pulse for %v, want %v", got, want)
+				}
+				if got, want := ev.Count, int64(p+1); got != want {
+					t.Errorf("%v: got count %v, want %v", names[i], got, want)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%v: timed out waiting for pulse %v", names[i], p)
+			}
+			board.SetInput(i, 0)
+		}
+	}
+
+	for i, mon := range mons {
+		if err := mon.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ev := <-chs[i]:
+			t.Errorf("%v: unexpected pulse: %v", names[i], ev)
+		default:
+		}
+		// Stop must have flushed all of the queued timestamps.
+		times := readTestTimestamps(t, filepath.Join(dir, names[i]+".ts"))
+		if got, want := len(times), i+1; got != want {
+			t.Errorf("%v: got %v timestamps, want %v", names[i], got, want)
+		}
+	}
+
+	// Restarting a Monitor must not double count its recent history.
+	mon := mons[0]
+	if err := mon.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	count, _ := mon.Count(names[0])
+	recent, _ := mon.CountSince(names[0], time.Time{})
+	if count != 1 || recent != 1 {
+		t.Errorf("got count %v and recent count %v after restart, want 1 and 1", count, recent)
+	}
+	if err := mon.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopAborts(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	board := internal.NewSimulatedBoard(nil, false)
+	defer board.Close()
+
+	mon := newTestMonitor(t, board, dir, "water", 0, `, "relay_pin": 0, "relay_hold_ms": 500`)
+	if err := mon.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	relay, _ := board.Relay(0)
+	sr := relay.(*internal.SimulatedOutput)
+
+	const pulses = 10
+	now := time.Now()
+	for i := 0; i < pulses; i++ {
+		mon.Pulse("water", now.Add(time.Duration(i)*time.Second))
+	}
+	// Wait for the relay to start forwarding the pulses.
+	for sr.Count() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if got, want := mon.Stop(ctx), context.DeadlineExceeded; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("Stop took %v to abort", took)
+	}
+	if n := sr.Count(); n >= pulses {
+		t.Errorf("all %v pulses were forwarded", n)
+	}
+	if sr.State() != 0 {
+		t.Errorf("relay was left on")
+	}
+	// Timestamps are persisted even when forwarding is aborted.
+	if got, want := len(readTestTimestamps(t, filepath.Join(dir, "water.ts"))), pulses; got != want {
+		t.Errorf("got %v timestamps, want %v", got, want)
+	}
+}
@@ -0,0 +1,204 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+const (
+	// maximum number of pulse timestamps or widths that may be queued
+	// for persistence, any more are dropped.
+	maxQueuedPulses = 1 << 16
+	// pulses that are queued for longer than this before being persisted
+	// are counted as delayed.
+	maxPersistDelay = 10 * time.Second
+	// how often the pipeline statistics are checked for alerts.
+	pipelineCheckInterval = time.Minute
+)
+
+// pipeline decouples pulse detection from persistence. Detection appends
+// to in-memory queues, which never block, and a separate persistence
+// stage drains them in batches. Any pulses that are dropped, because the
+// queues are full, or delayed, because persistence is slow or failing,
+// are counted.
+type pipeline struct {
+	// statistics, these must be the first fields to ensure 64 bit
+	// alignment for atomic access on 32 bit platforms.
+	dropped, delayed, failed int64
+
+	mu     sync.Mutex
+	times  []time.Time
+	widths []internal.PulseWidth
+	// time at which the oldest entry currently queued was queued.
+	oldest  time.Time
+	lastErr error
+	ready   chan struct{}
+}
+
+func newPipeline() *pipeline {
+	return &pipeline{ready: make(chan struct{}, 1)}
+}
+
+func (p *pipeline) signal() {
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pipeline) queuedLocked() bool {
+	return len(p.times) > 0 || len(p.widths) > 0
+}
+
+// pushTime queues a pulse timestamp for persistence.
+func (p *pipeline) pushTime(when time.Time) {
+	p.mu.Lock()
+	if len(p.times) >= maxQueuedPulses {
+		p.mu.Unlock()
+		atomic.AddInt64(&p.dropped, 1)
+		return
+	}
+	if !p.queuedLocked() {
+		p.oldest = time.Now()
+	}
+	p.times = append(p.times, when)
+	p.mu.Unlock()
+	p.signal()
+}
+
+// pushWidth queues a pulse width for persistence.
+func (p *pipeline) pushWidth(pw internal.PulseWidth) {
+	p.mu.Lock()
+	if len(p.widths) >= maxQueuedPulses {
+		p.mu.Unlock()
+		atomic.AddInt64(&p.dropped, 1)
+		return
+	}
+	if !p.queuedLocked() {
+		p.oldest = time.Now()
+	}
+	p.widths = append(p.widths, pw)
+	p.mu.Unlock()
+	p.signal()
+}
+
+// take returns all of the currently queued timestamps and widths and the
+// time at which the oldest of them was queued.
+func (p *pipeline) take() ([]time.Time, []internal.PulseWidth, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	times, widths, oldest := p.times, p.widths, p.oldest
+	p.times, p.widths = nil, nil
+	return times, widths, oldest
+}
+
+// requeue returns timestamps and widths that could not be persisted to
+// the front of the queues so that they will be retried.
+func (p *pipeline) requeue(times []time.Time, widths []internal.PulseWidth, oldest time.Time, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	atomic.AddInt64(&p.failed, 1)
+	p.lastErr = err
+	p.times = append(times, p.times...)
+	p.widths = append(widths, p.widths...)
+	p.oldest = oldest
+}
+
+func (p *pipeline) lastError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastErr
+}
+
+// persist is the persistence stage of the pipeline, it appends batches of
+// queued timestamps and widths to the timestamp and pulse width files.
+// Any pulses still queued when ctx is cancelled are persisted before it
+// returns.
+func persist(ctx context.Context, m *meter, timestampFile, widthsFile *internal.TimestampFileWriter) {
+	p := m.pipeline
+	retry := time.NewTicker(time.Second)
+	defer retry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := persistQueued(m, timestampFile, widthsFile); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v: failed to persist queued pulses on shutdown: %v\n", m, err)
+			}
+			return
+		case <-p.ready:
+		case <-retry.C:
+		}
+		persistQueued(m, timestampFile, widthsFile)
+	}
+}
+
+// persistQueued appends all of the currently queued timestamps and widths
+// to the timestamp and pulse width files, anything that is not persisted
+// is requeued. Delayed pulses are counted once they are persisted so that
+// pulses that are retried are not counted repeatedly.
+func persistQueued(m *meter, timestampFile, widthsFile *internal.TimestampFileWriter) error {
+	p := m.pipeline
+	times, widths, oldest := p.take()
+	if len(times) == 0 && len(widths) == 0 {
+		return nil
+	}
+	delayed := time.Since(oldest) > maxPersistDelay
+	if len(times) > 0 {
+		n, err := timestampFile.AppendBatch(times)
+		if delayed {
+			atomic.AddInt64(&p.delayed, int64(n))
+		}
+		if err != nil {
+			p.requeue(times[n:], widths, oldest, err)
+			return err
+		}
+	}
+	if len(widths) > 0 {
+		n, err := widthsFile.AppendPulseWidths(widths)
+		if err != nil {
+			p.requeue(nil, widths[n:], oldest, err)
+			return err
+		}
+	}
+	if m.verbose() {
+		fmt.Fprintf(os.Stderr, "%v: persisted %v pulse timestamps, %v pulse widths\n", m, len(times), len(widths))
+	}
+	return nil
+}
+
+// monitorPipeline periodically checks the pipeline statistics and sends
+// an alert if any pulses have been dropped or delayed or if persistence
+// is failing.
+func monitorPipeline(ctx context.Context, m *meter, smtp *internal.SMTPClient) {
+	p := m.pipeline
+	var dropped, delayed, failed int64
+	for sleep(ctx, internal.SystemClock, pipelineCheckInterval) {
+		curDropped := atomic.LoadInt64(&p.dropped)
+		curDelayed := atomic.LoadInt64(&p.delayed)
+		curFailed := atomic.LoadInt64(&p.failed)
+		var msgs []string
+		if n := curDropped - dropped; n > 0 {
+			msgs = append(msgs, fmt.Sprintf("%v pulses were dropped before being persisted", n))
+		}
+		if n := curDelayed - delayed; n > 0 {
+			msgs = append(msgs, fmt.Sprintf("%v pulses were delayed by more than %v before being persisted", n, maxPersistDelay))
+		}
+		if n := curFailed - failed; n > 0 {
+			msgs = append(msgs, fmt.Sprintf("%v attempts to persist pulses failed, most recently: %v", n, p.lastError()))
+		}
+		dropped, delayed, failed = curDropped, curDelayed, curFailed
+		for _, msg := range msgs {
+			msg = fmt.Sprintf("ERROR: %v: %v: %v\n", m, msg, time.Now())
+			os.Stderr.WriteString(msg)
+			if err := smtp.Alert(msg); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR sending email: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package monitor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// shortFile is an os.File whose writes fail once limit bytes have been
+// written.
+type shortFile struct {
+	*os.File
+	limit int
+}
+
+func (f *shortFile) Write(buf []byte) (int, error) {
+	if len(buf) <= f.limit {
+		n, err := f.File.Write(buf)
+		f.limit -= n
+		return n, err
+	}
+	n, _ := f.File.Write(buf[:f.limit])
+	f.limit -= n
+	return n, errors.New("no space left on device")
+}
+
+func openShortFile(t *testing.T, filename string, limit int) (*internal.TimestampFileWriter, *shortFile) {
+	t.Helper()
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf := &shortFile{File: f, limit: limit}
+	return &internal.TimestampFileWriter{WriteCloser: sf}, sf
+}
+
+func TestPersistQueued(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	config := readTestConfig(t, dir, `"hardware": "none", "pulse_timestamps_file": "unused.ts"`)
+	start := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+
+	const unlimited = 1 << 20
+	for i, tc := range []struct {
+		pulses, widths int
+		// bytes that may be written to each file before a write fails.
+		limit, widthsLimit    int
+		delayed               bool
+		persisted, requeued   int
+		persistedWidths       int
+		requeuedWidths        int
+		failed, delayedPulses int64
+	}{
+		{0, 0, unlimited, unlimited, false, 0, 0, 0, 0, 0, 0},
+		{3, 2, unlimited, unlimited, false, 3, 0, 2, 0, 0, 0},
+		{3, 2, unlimited, unlimited, true, 3, 0, 2, 0, 0, 3},
+		// A partially written timestamp is requeued along with all of
+		// the widths.
+		{3, 2, 12, unlimited, false, 1, 2, 0, 2, 1, 0},
+		{3, 2, 0, unlimited, true, 0, 3, 0, 2, 1, 0},
+		{3, 2, 16, unlimited, true, 2, 1, 0, 2, 1, 2},
+		{3, 2, unlimited, 20, false, 3, 0, 1, 1, 1, 0},
+	} {
+		mon, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := mon.meters[0]
+		p := m.pipeline
+		for j := 0; j < tc.pulses; j++ {
+			p.pushTime(start.Add(time.Duration(j) * time.Second))
+		}
+		for j := 0; j < tc.widths; j++ {
+			rising := start.Add(time.Duration(j) * time.Second)
+			p.pushWidth(internal.PulseWidth{Rising: rising, Falling: rising.Add(100 * time.Millisecond)})
+		}
+		if tc.delayed {
+			p.oldest = time.Now().Add(-2 * maxPersistDelay)
+		}
+		timestamps := filepath.Join(dir, "timestamps.ts")
+		widths := filepath.Join(dir, "widths.ts")
+		os.Remove(timestamps)
+		os.Remove(widths)
+		tf, tsf := openShortFile(t, timestamps, tc.limit)
+		wf, wsf := openShortFile(t, widths, tc.widthsLimit)
+
+		err = persistQueued(m, tf, wf)
+		if got, want := err != nil, tc.requeued+tc.requeuedWidths > 0; got != want {
+			t.Errorf("%v: got error %v, want an error: %v", i, err, want)
+		}
+		times := readTestTimestamps(t, timestamps)
+		if got, want := len(times), tc.persisted; got != want {
+			t.Errorf("%v: got %v persisted timestamps, want %v", i, got, want)
+		}
+		if got, want := len(readTestTimestamps(t, widths)), 2*tc.persistedWidths; got != want {
+			t.Errorf("%v: got %v persisted width timestamps, want %v", i, got, want)
+		}
+		if got, want := len(p.times), tc.requeued; got != want {
+			t.Errorf("%v: got %v requeued timestamps, want %v", i, got, want)
+		}
+		if got, want := len(p.widths), tc.requeuedWidths; got != want {
+			t.Errorf("%v: got %v requeued widths, want %v", i, got, want)
+		}
+		if got, want := atomic.LoadInt64(&p.failed), tc.failed; got != want {
+			t.Errorf("%v: got %v failures, want %v", i, got, want)
+		}
+		if got, want := atomic.LoadInt64(&p.delayed), tc.delayedPulses; got != want {
+			t.Errorf("%v: got %v delayed pulses, want %v", i, got, want)
+		}
+
+		// Retrying once there is space persists the remainder, in order.
+		tsf.limit, wsf.limit = unlimited, unlimited
+		if err := persistQueued(m, tf, wf); err != nil {
+			t.Errorf("%v: %v", i, err)
+		}
+		tf.Close()
+		wf.Close()
+		times = readTestTimestamps(t, timestamps)
+		if got, want := len(times), tc.pulses; got != want {
+			t.Errorf("%v: got %v timestamps after retrying, want %v", i, got, want)
+		}
+		for j, ts := range times {
+			if want := start.Add(time.Duration(j) * time.Second); !ts.Equal(want) {
+				t.Errorf("%v: %v: got %v, want %v", i, j, ts, want)
+			}
+		}
+		if got, want := len(readTestTimestamps(t, widths)), 2*tc.widths; got != want {
+			t.Errorf("%v: got %v width timestamps after retrying, want %v", i, got, want)
+		}
+	}
+}
+
+func TestPipelineDropped(t *testing.T) {
+	p := newPipeline()
+	now := time.Now()
+	for i := 0; i < maxQueuedPulses+3; i++ {
+		p.pushTime(now)
+	}
+	for i := 0; i < maxQueuedPulses+2; i++ {
+		p.pushWidth(internal.PulseWidth{Rising: now, Falling: now})
+	}
+	if got, want := atomic.LoadInt64(&p.dropped), int64(5); got != want {
+		t.Errorf("got %v dropped pulses, want %v", got, want)
+	}
+	times, widths, _ := p.take()
+	if len(times) != maxQueuedPulses || len(widths) != maxQueuedPulses {
+		t.Errorf("got %v timestamps and %v widths, want %v", len(times), len(widths), maxQueuedPulses)
+	}
+	// Once drained, pulses are queued again.
+	p.pushTime(now)
+	if got, want := atomic.LoadInt64(&p.dropped), int64(5); got != want {
+		t.Errorf("got %v dropped pulses, want %v", got, want)
+	}
+}
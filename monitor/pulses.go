@@ -0,0 +1,207 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// replayClockInterval is the interval, in real time, at which the
+// simulated clock is advanced whilst replaying.
+const replayClockInterval = 10 * time.Millisecond
+
+// poll counts pulses by polling the input. A pulse is timestamped with
+// the time of the first closed sample that started it and hence is
+// accurate to within the polling interval, ie. the time since the
+// preceding open sample. If midpoint is true the timestamp is instead
+// taken as the midpoint between those two samples.
+func poll(ctx context.Context, m *meter, input internal.DigitalInput, pin int, interval time.Duration, debouncer *internal.Debouncer, midpoint bool) {
+	fmt.Printf("%v: polling pin %v, interval %v, debounce %v\n", m, pin, interval, m.debounceDescription())
+	for sleep(ctx, internal.SystemClock, interval) {
+		now, val := time.Now(), input.Value()
+		m.sampled(val)
+		m.debounced(debouncer.Update(now, val), midpoint)
+	}
+}
+
+// detect counts pulses from a stream of timestamped edge events, each
+// pulse is timestamped with the time of the rising edge that started it.
+// The input is read once before waiting for edges since no edge is
+// received for an input that is already closed.
+func detect(ctx context.Context, m *meter, input internal.DigitalInput, edges <-chan internal.Edge, debouncer *internal.Debouncer) {
+	fmt.Printf("%v: waiting for edge events, debounce %v\n", m, m.debounceDescription())
+	m.sampled(input.Value())
+	var deadline <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case edge, ok := <-edges:
+			if !ok {
+				fmt.Fprintf(os.Stderr, "ERROR: %v: edge events are no longer available\n", m)
+				return
+			}
+			m.sampled(edge.Value)
+			m.debounced(exact(debouncer.Update(edge.Time, edge.Value)), false)
+		case now := <-deadline:
+			// The input has not changed since the last edge.
+			m.debounced(exact(debouncer.Update(now, debouncer.Value())), false)
+		}
+		deadline = nil
+		if dl := debouncer.Deadline(); !dl.IsZero() {
+			deadline = time.After(time.Until(dl))
+		}
+	}
+}
+
+// exact clears the uncertainty of debounce events derived from edge
+// events since, unlike polled samples, their times are exact.
+func exact(events []internal.DebounceEvent) []internal.DebounceEvent {
+	for i := range events {
+		events[i].Uncertainty = 0
+	}
+	return events
+}
+
+// replay counts the pulses replayed from a previously recorded timestamp
+// file. Each pulse is replayed, and timestamped, at the time at which it
+// was recorded shifted so that the first pulse is replayed at start, as
+// measured by the meter's clock. Hence the rate, and all other time based
+// logic, is the same as when the pulses were recorded, provided that the
+// clock is advanced at the replay speed, see driveClock.
+func replay(ctx context.Context, m *meter, replayer *internal.TimestampReplayer, start time.Time) {
+	fmt.Printf("%v: replaying pulses from %v at %vx\n", m, replayer, m.config.ReplaySpeed)
+	n := 0
+	err := replayer.Replay(ctx, m.clock(), start, func(recorded, when time.Time) {
+		if m.verbose() {
+			fmt.Fprintf(os.Stderr, "%v: replaying pulse recorded at %v at %v\n", m, recorded, when)
+		}
+		n++
+		m.pulse(when)
+	})
+	if err != nil && err != ctx.Err() {
+		fmt.Fprintf(os.Stderr, "ERROR: %v: replaying pulses: %v\n", m, err)
+	}
+	fmt.Printf("%v: replayed %v pulses from %v\n", m, n, replayer)
+}
+
+// driveClock advances the simulated clock used whilst replaying in step
+// with real time, speeded up by speed until replayed is closed and in
+// real time thereafter, until ctx is cancelled. The clock keeps running
+// through quiet periods in, and after the end of, the replay so that the
+// alert rules, daily email and leak tests all behave as they would have
+// done originally.
+func driveClock(ctx context.Context, clock *internal.SimulatedClock, speed float64, replayed <-chan struct{}) {
+	last := time.Now()
+	for sleep(ctx, internal.SystemClock, replayClockInterval) {
+		now := time.Now()
+		elapsed := now.Sub(last)
+		last = now
+		select {
+		case <-replayed:
+		default:
+			elapsed = time.Duration(float64(elapsed) * speed)
+		}
+		clock.Advance(elapsed)
+	}
+}
+
+// forwardRelay forwards the pulses counted for m beyond the first last
+// pulses via a relay. Once ctx is cancelled it forwards any pulses that
+// remain to be forwarded, unless abort is cancelled first, and returns.
+func forwardRelay(ctx, abort context.Context, m *meter, last int64, relay internal.DigitalOutput, interval time.Duration, relayPin int, relayHold time.Duration) {
+	fmt.Printf("%v: relay pin %v\n", m, relayPin)
+	relay.Off()
+	for {
+		running := sleep(ctx, internal.SystemClock, interval)
+		cur := m.count()
+		if seen := cur - last; seen > 0 {
+			if m.verbose() {
+				fmt.Fprintf(os.Stderr, "%v: Forwarding %v pulses via a relay\n", m, seen)
+			}
+			if !pulseOutput(abort, relay, seen, relayHold) {
+				fmt.Fprintf(os.Stderr, "ERROR: %v: stopped before forwarding all pulses via a relay\n", m)
+				return
+			}
+		}
+		last = cur
+		if !running {
+			return
+		}
+	}
+}
+
+// forwardSwitch forwards the pulses counted for m via a cmos output in
+// the same manner as forwardRelay.
+func forwardSwitch(ctx, abort context.Context, m *meter, last int64, output internal.DigitalOutput, interval time.Duration, outputPin int, outputHold time.Duration) {
+	fmt.Printf("%v: Output pin %v\n", m, outputPin)
+	output.Off()
+	for {
+		running := sleep(ctx, internal.SystemClock, interval)
+		cur := m.count()
+		if seen := cur - last; seen > 0 {
+			if m.verbose() {
+				fmt.Fprintf(os.Stderr, "%v: Forwarding %v pulses via cmos output\n", m, seen)
+			}
+			if !pulseOutput(abort, output, seen, outputHold) {
+				fmt.Fprintf(os.Stderr, "ERROR: %v: stopped before forwarding all pulses via cmos output\n", m)
+				return
+			}
+		}
+		last = cur
+		if !running {
+			return
+		}
+	}
+}
+
+// pulseOutput turns output on, for hold, and then off again n times. It
+// returns false if abort is cancelled first, leaving the output off.
+func pulseOutput(abort context.Context, output internal.DigitalOutput, n int64, hold time.Duration) bool {
+	for i := int64(0); i < n; i++ {
+		output.On()
+		held := sleep(abort, internal.SystemClock, hold)
+		output.Off()
+		if !held {
+			return false
+		}
+	}
+	return true
+}
+
+func console(ctx context.Context, m *meter, leds internal.LEDBank) {
+	var prev, cur int64
+	storage := make([]byte, 0, 128)
+	var buf []byte
+	if leds != nil {
+		leds.Set(4, 0)
+		leds.Set(5, 0)
+		leds.Set(6, 0)
+	}
+
+	for sleep(ctx, internal.SystemClock, 500*time.Millisecond) {
+		cur = m.count()
+		if cur != prev {
+			prev = cur
+			if leds != nil {
+				val := byte(cur & 0xff)
+				leds.Set(4, val&0x01)
+				leds.Set(5, (val&0x02)>>1)
+				leds.Set(6, (val&0x04)>>2)
+				leds.Set(7, (val&0x08)>>3)
+			}
+			buf = append(storage, m.config.Name...)
+			buf = append(buf, ':', ' ')
+			buf = strconv.AppendInt(buf, cur, 10)
+			now := time.Now().String()
+			buf = append(buf, ' ', '-', ' ')
+			buf = append(buf, []byte(now)...)
+			buf = append(buf, '\n')
+			os.Stderr.Write(buf)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+func writeTimestamps(t *testing.T, filename string, times []time.Time) {
+	t.Helper()
+	wr, err := internal.NewTimestampFileWriter(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wr.AppendBatch(times); err != nil {
+		t.Fatal(err)
+	}
+	if err := wr.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	recorded := time.Date(2020, 7, 4, 2, 0, 0, 0, time.UTC)
+	gaps := []time.Duration{0, 10 * time.Minute, 2 * time.Hour, time.Second}
+	var times []time.Time
+	for _, gap := range gaps {
+		recorded = recorded.Add(gap)
+		times = append(times, recorded)
+	}
+	replayFile := filepath.Join(dir, "incident.ts")
+	writeTimestamps(t, replayFile, times)
+
+	config := readTestConfig(t, dir, fmt.Sprintf(`"hardware": "none",
+"input_backend": "replay", "replay_file": %q, "replay_speed": 1000000,
+"pulse_timestamps_file": %q`, replayFile, filepath.Join(dir, "water.ts")))
+	mon, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock, ok := mon.clock.(*internal.SimulatedClock)
+	if !ok {
+		t.Fatalf("replay does not use a simulated clock: %T", mon.clock)
+	}
+	started := clock.Now()
+
+	ch := make(chan PulseEvent, len(times))
+	defer mon.Subscribe(ch)()
+	if err := mon.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Stop(context.Background())
+
+	for i := range times {
+		var ev PulseEvent
+		select {
+		case ev = <-ch:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for pulse %v", i)
+		}
+		if got, want := ev.Time.Sub(started), times[i].Sub(times[0]); got != want {
+			t.Errorf("pulse %v: got %v after the start, want %v", i, got, want)
+		}
+		if now := clock.Now(); now.Before(ev.Time) {
+			t.Errorf("pulse %v: clock %v is before the pulse %v", i, now, ev.Time)
+		}
+	}
+	// The clock continues to run once the replay is finished.
+	last := clock.Now()
+	time.Sleep(10 * replayClockInterval)
+	if now := clock.Now(); !now.After(last) {
+		t.Errorf("clock stopped at %v", now)
+	}
+}
+
+func TestReplayQuietPeriod(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// A few minutes of flow, a 3 hour quiet period and then a few more.
+	recorded := time.Date(2020, 7, 4, 2, 0, 0, 0, time.UTC)
+	var times []time.Time
+	for _, offset := range []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Hour, 3*time.Hour + time.Minute} {
+		times = append(times, recorded.Add(offset))
+	}
+	replayFile := filepath.Join(dir, "incident.ts")
+	writeTimestamps(t, replayFile, times)
+
+	config := readTestConfig(t, dir, fmt.Sprintf(`"hardware": "none",
+"input_backend": "replay", "replay_file": %q, "replay_speed": 10000,
+"pulse_timestamps_file": %q`, replayFile, filepath.Join(dir, "water.ts")))
+	mon, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := mon.clock.Now()
+
+	ch := make(chan PulseEvent, len(times))
+	defer mon.Subscribe(ch)()
+	lines := captureStdout(t)
+	if err := mon.Start(context.Background()); err != nil {
+		lines()
+		t.Fatal(err)
+	}
+	for i := range times {
+		select {
+		case <-ch:
+		case <-time.After(10 * time.Second):
+			lines()
+			t.Fatalf("timed out waiting for pulse %v", i)
+		}
+		if i != 2 {
+			continue
+		}
+		// The clock keeps running during the quiet period, 3 hours take
+		// about a second to replay.
+		deadline := time.Now().Add(10 * time.Second)
+		for mon.clock.Now().Sub(started) < 15*time.Minute && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := mon.clock.Now().Sub(started); got < 15*time.Minute || got > 3*time.Hour || len(ch) > 0 {
+			t.Errorf("clock stopped at %v during the quiet period", got)
+		}
+	}
+	if err := mon.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The no-flow rule, which fires when there are no pulses for 10
+	// minutes, is evaluated every minute during the quiet period rather
+	// than when the next pulse is replayed.
+	var alerts []time.Duration
+	for _, line := range lines() {
+		if !strings.HasPrefix(line, "ALERT: WARNING: water: no-flow: ") {
+			continue
+		}
+		parts := strings.Split(line, ": ")
+		when, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", strings.Split(parts[len(parts)-1], " m=")[0])
+		if err != nil {
+			t.Fatalf("%v: %v", line, err)
+		}
+		alerts = append(alerts, when.Sub(started))
+	}
+	if len(alerts) == 0 {
+		t.Fatalf("no-flow alert was not sent")
+	}
+	if got := alerts[0]; got < 12*time.Minute || got > 13*time.Minute {
+		t.Errorf("got no-flow alert %v after the start, want 12-13m", got)
+	}
+}
@@ -0,0 +1,65 @@
+package monitor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// hasSchedules returns true if the meter has any scheduled_usage rules.
+func (m *meter) hasSchedules() bool {
+	for i := range m.config.AlertRules {
+		if m.config.AlertRules[i].Type == internal.ScheduledUsageRule {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduled returns true if the specified time is within any of the
+// meter's scheduled_usage periods.
+func (m *meter) scheduled(when time.Time) bool {
+	for i := range m.config.AlertRules {
+		rule := &m.config.AlertRules[i]
+		if rule.Type == internal.ScheduledUsageRule && rule.Active(when) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastScheduledEnd returns the end of the most recent of the meter's
+// scheduled_usage periods to have ended at or before the specified time,
+// or the zero time if there are none.
+func (m *meter) lastScheduledEnd(now time.Time) time.Time {
+	var last time.Time
+	for i := range m.config.AlertRules {
+		rule := &m.config.AlertRules[i]
+		if rule.Type != internal.ScheduledUsageRule {
+			continue
+		}
+		if _, end := rule.LastPeriod(now); end.After(last) {
+			last = end
+		}
+	}
+	return last
+}
+
+// scheduleReport returns a description of the usage between start and
+// end broken out into that during the meter's scheduled_usage periods
+// and that outside of them.
+func (m *meter) scheduleReport(start, end time.Time) string {
+	var scheduled, unscheduled int64
+	for _, t := range m.history.Since(start) {
+		if !t.Before(end) {
+			break
+		}
+		if m.scheduled(t) {
+			scheduled++
+		} else {
+			unscheduled++
+		}
+	}
+	return fmt.Sprintf("%v scheduled, %v unscheduled", m.usage(scheduled), m.usage(unscheduled))
+}
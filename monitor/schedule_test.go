@@ -0,0 +1,108 @@
+package monitor
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+func newScheduleTestMeter(t *testing.T, dir string) *meter {
+	t.Helper()
+	config := readTestConfig(t, dir, `"hardware": "none", "pulse_timestamps_file": "unused.ts",
+"alert_rules": [
+  {"name": "irrigation", "type": "scheduled_usage", "days": ["sat"], "between": "02:00-03:30", "max_volume": 250},
+  {"name": "night", "type": "scheduled_usage", "between": "23:30-00:30"},
+  {"name": "high-flow", "type": "rate_above", "window": "10m", "pulses": 5, "except_scheduled": true}
+]`)
+	mon, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mon.meters[0]
+}
+
+func TestExceptScheduled(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	m := newScheduleTestMeter(t, dir)
+	state := &ruleState{rule: &m.config.AlertRules[2]}
+
+	// 4th July 2020 is a Saturday.
+	at := func(h, m int) time.Time { return time.Date(2020, 7, 4, h, m, 0, 0, time.UTC) }
+	started := at(0, 45)
+	// Heavy flow at the end of the scheduled period and again afterwards.
+	var flow []time.Time
+	for _, from := range []time.Time{at(3, 25), at(3, 40)} {
+		for i := 0; i < 10; i++ {
+			flow = append(flow, from.Add(time.Duration(i)*10*time.Second))
+		}
+	}
+	for i, tc := range []struct {
+		now     time.Time
+		applies bool
+		firing  bool
+	}{
+		{at(1, 0), true, false},
+		{at(3, 0), false, false},
+		{at(3, 29), false, false},
+		// The window is reset at the end of the scheduled period so the
+		// flow from before then is not counted.
+		{at(3, 30), true, false},
+		{at(3, 31), true, false},
+		{at(3, 39), true, false},
+		{at(3, 42), true, true},
+	} {
+		for len(flow) > 0 && !flow[0].After(tc.now) {
+			m.history.Add(flow[0])
+			flow = flow[1:]
+		}
+		state.lastCheck = tc.now.Add(-time.Minute)
+		since, applies := state.applies(m, started, tc.now)
+		if applies != tc.applies {
+			t.Errorf("%v: %v: got applies %v, want %v", i, tc.now, applies, tc.applies)
+			continue
+		}
+		if !applies {
+			continue
+		}
+		if firing, text := state.evaluate(m, since, tc.now); firing != tc.firing {
+			t.Errorf("%v: %v: got firing %v (%v), want %v", i, tc.now, firing, text, tc.firing)
+		}
+	}
+}
+
+func TestScheduleReport(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	m := newScheduleTestMeter(t, dir)
+	m.history = internal.NewPulseHistory(7 * 24 * time.Hour)
+
+	at := func(d, h, m int) time.Time { return time.Date(2020, 7, d, h, m, 0, 0, time.UTC) }
+	for _, when := range []time.Time{
+		// Friday night's schedule, spanning midnight.
+		at(3, 23, 45), at(4, 0, 15),
+		// Saturday.
+		at(4, 1, 59), at(4, 2, 0), at(4, 3, 0), at(4, 3, 30),
+		at(4, 23, 29), at(4, 23, 30),
+		// Sunday, the irrigation schedule only applies on Saturdays.
+		at(5, 2, 30),
+	} {
+		m.history.Add(when)
+	}
+	for i, tc := range []struct {
+		start, end time.Time
+		report     string
+	}{
+		{at(3, 0, 0), at(6, 0, 0), "50 gallons scheduled, 40 gallons unscheduled"},
+		{at(3, 0, 0), at(5, 0, 0), "50 gallons scheduled, 30 gallons unscheduled"},
+		{at(4, 0, 0), at(5, 0, 0), "40 gallons scheduled, 30 gallons unscheduled"},
+		{at(4, 2, 0), at(4, 3, 0), "10 gallons scheduled, 0 gallons unscheduled"},
+		{at(6, 0, 0), at(7, 0, 0), "0 gallons scheduled, 0 gallons unscheduled"},
+	} {
+		if got, want := m.scheduleReport(tc.start, tc.end), tc.report; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
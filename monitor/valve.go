@@ -0,0 +1,129 @@
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+// valve controls a meter's motorised shut-off valve, the valve is closed
+// by turning its relay on.
+type valve struct {
+	m     *meter
+	relay internal.DigitalOutput
+	smtp  *internal.SMTPClient
+
+	mu    sync.Mutex
+	state *internal.ShutoffState
+}
+
+// newValve creates the valve for m, restoring its state from the
+// meter's shutoff_state_file if any so that a valve that was closed
+// before a restart remains closed.
+func newValve(m *meter, relay internal.DigitalOutput, smtp *internal.SMTPClient) (*valve, error) {
+	state := &internal.ShutoffState{}
+	if filename := m.config.ShutoffStateFile; len(filename) > 0 {
+		var err error
+		if state, err = internal.ReadShutoffState(filename); err != nil {
+			return nil, err
+		}
+	}
+	v := &valve{m: m, relay: relay, smtp: smtp, state: state}
+	fmt.Printf("%v: shut-off valve relay pin %v: %v\n", m, m.config.ShutoffRelayPin, v.report())
+	if state.Closed {
+		relay.On()
+	} else {
+		relay.Off()
+	}
+	return v, nil
+}
+
+// close closes the valve, unless it is already closed or doing so would
+// exceed the meter's maximum number of actuations. The notification is
+// sent once mu is released so that a slow email server does not delay
+// the evaluation of alert rules or calls to Monitor.Shutoff.
+func (v *valve) close(now time.Time, reason string) {
+	if kind, text := v.actuate(now, reason); len(kind) > 0 {
+		v.notify(kind, now, text)
+	}
+}
+
+// actuate closes the valve, as per close, and returns the kind and text
+// of the notification to be sent, if any.
+func (v *valve) actuate(now time.Time, reason string) (string, string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.state.Closed {
+		return "", ""
+	}
+	cfg := v.m.config
+	if err := v.state.Actuate(now, reason, cfg.ShutoffMaxActuations, cfg.ShutoffActuationDuration); err != nil {
+		return "SHUTOFF SUPPRESSED", fmt.Sprintf("not closing the valve for %v: %v", reason, err)
+	}
+	v.relay.On()
+	v.save()
+	return "SHUTOFF", fmt.Sprintf("valve closed for %v, it will remain closed until reset", reason)
+}
+
+// reset reopens a closed valve, the notification is sent once mu is
+// released.
+func (v *valve) reset(now time.Time) error {
+	v.mu.Lock()
+	if !v.state.Closed {
+		v.mu.Unlock()
+		return fmt.Errorf("shut-off valve is not closed")
+	}
+	closed := v.report()
+	v.state.Reset(now)
+	v.relay.Off()
+	v.save()
+	v.mu.Unlock()
+	v.notify("SHUTOFF RESET", now, fmt.Sprintf("valve reopened, it was %v", closed))
+	return nil
+}
+
+// status returns whether the valve is closed and, if so, why.
+func (v *valve) status() (bool, string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.state.Closed, v.state.Reason
+}
+
+func (v *valve) String() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.report()
+}
+
+// report returns a description of the valve's state, it must be called
+// with mu held.
+func (v *valve) report() string {
+	if !v.state.Closed {
+		return "open"
+	}
+	return fmt.Sprintf("closed since %v for %v", v.state.Time, v.state.Reason)
+}
+
+// save records the valve's state, it must be called with mu held.
+func (v *valve) save() {
+	filename := v.m.config.ShutoffStateFile
+	if len(filename) == 0 {
+		return
+	}
+	if err := internal.WriteShutoffState(filename, v.state); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v: failed to save shut-off valve state: %v\n", v.m, err)
+	}
+}
+
+// notify sends a notification of a change to the state of the valve to
+// the console and by email, it must not be called with mu held.
+func (v *valve) notify(kind string, now time.Time, text string) {
+	msg := fmt.Sprintf("%v: %v: %v: %v\n", kind, v.m, text, now)
+	os.Stdout.WriteString(msg)
+	if err := v.smtp.Alert(msg); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR sending email: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pulsemon/internal"
+)
+
+func TestValve(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	config := readTestConfig(t, dir, `"hardware": "simulated", "pulse_timestamps_file": "unused.ts",
+"shutoff_relay_pin": 1, "shutoff_max_actuations": 2, "shutoff_state_file": "`+filepath.Join(dir, "valve.json")+`",
+"alert_rules": [{"name": "burst", "type": "continuous_run", "idle": "2m", "volume": 100, "shutoff": true}]`)
+	board := internal.NewSimulatedBoard(nil, false)
+	defer board.Close()
+	mon, err := New(config, WithBoard(board))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mon.meters[0]
+	output, _ := board.Relay(1)
+	relay := output.(*internal.SimulatedOutput)
+
+	lines := captureStdout(t)
+	v, err := newValve(m, relay, nil)
+	if err != nil {
+		lines()
+		t.Fatal(err)
+	}
+	lines()
+
+	start := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	for i, tc := range []struct {
+		hour   int
+		action string
+		closed bool
+		notify string
+	}{
+		{0, "close", true, "SHUTOFF: "},
+		// The valve is latched closed.
+		{1, "close", true, ""},
+		{2, "reset", false, "SHUTOFF RESET: "},
+		{3, "reset", false, ""},
+		{4, "close", true, "SHUTOFF: "},
+		{5, "reset", false, "SHUTOFF RESET: "},
+		// No more than 2 actuations within 24 hours.
+		{6, "close", false, "SHUTOFF SUPPRESSED: "},
+		{24, "close", true, "SHUTOFF: "},
+		// A restart restores the closed valve.
+		{25, "restart", true, ""},
+		{26, "reset", false, "SHUTOFF RESET: "},
+		{27, "restart", false, ""},
+	} {
+		now := start.Add(time.Duration(tc.hour) * time.Hour)
+		lines := captureStdout(t)
+		switch tc.action {
+		case "close":
+			v.close(now, "burst")
+		case "reset":
+			err = v.reset(now)
+		case "restart":
+			// Invert the relay to ensure that it is set by newValve.
+			if tc.closed {
+				relay.Off()
+			} else {
+				relay.On()
+			}
+			v, err = newValve(m, relay, nil)
+		}
+		got := lines()
+		if tc.action == "reset" && (err == nil) != (len(tc.notify) > 0) {
+			t.Errorf("%v: reset: unexpected error: %v", i, err)
+		}
+		if tc.action == "restart" && err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if closed, _ := v.status(); closed != tc.closed {
+			t.Errorf("%v: %v: got closed %v, want %v", i, tc.action, closed, tc.closed)
+		}
+		if got, want := relay.State() == 1, tc.closed; got != want {
+			t.Errorf("%v: %v: got relay on %v, want %v", i, tc.action, got, want)
+		}
+		switch {
+		case tc.action == "restart":
+		case len(tc.notify) == 0 && len(got) > 0:
+			t.Errorf("%v: %v: unexpected notification: %v", i, tc.action, got)
+		case len(tc.notify) > 0 && (len(got) != 1 || !strings.HasPrefix(got[0], tc.notify)):
+			t.Errorf("%v: %v: got %v, want a %v notification", i, tc.action, got, tc.notify)
+		}
+	}
+}
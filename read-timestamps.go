@@ -1,3 +1,4 @@
+//go:build ignore
 // +build ignore
 
 package main
@@ -14,20 +15,29 @@ import (
 
 type CommonFlags struct {
 	TimeZoneLocation string `subcmd:"location,Local,'timezone specified as a location to use for interpreting times,'"`
+	Config           string `subcmd:"config,,'pulsemon configuration file, required for --meter'"`
+	Meter            string `subcmd:"meter,,'name of the meter, in the configuration file, to report on. Its timestamp file and units are used unless overridden'"`
 }
 
 type dumpFlags struct {
 	StartDate string `subcmd:"start,,start of time period in MM-DD-YY or DD-MM-YY:HH:MM format"`
 	EndDate   string `subcmd:"end,,end of time period in MM-DD-YY or DD-MM-YY:HH:MM format"`
+	Widths    string `subcmd:"widths,,'pulse widths file, if specified the width of each pulse is included in the output'"`
 	CommonFlags
 }
 
 type usageFlags struct {
 	CommonFlags
-	StartDate     string `subcmd:"start,,start of time period in MM-DD-YY format"`
-	EndDate       string `subcmd:"end,,end of time period in MM-DD-YY format"`
-	UnitsPerPulse int    `subcmd:"units-per-pulse,10,number of units per relay/meter pulse"`
-	Period        string `subcmd:"period,24h,time period for usage calculations"`
+	StartDate     string  `subcmd:"start,,start of time period in MM-DD-YY format"`
+	EndDate       string  `subcmd:"end,,end of time period in MM-DD-YY format"`
+	UnitsPerPulse float64 `subcmd:"units-per-pulse,10,number of units per relay/meter pulse"`
+	Period        string  `subcmd:"period,24h,time period for usage calculations"`
+}
+
+type registerFlags struct {
+	CommonFlags
+	Reading float64 `subcmd:"reading,0,the reading shown on the physical meter"`
+	At      string  `subcmd:"at,,'time at which the meter was read in MM-DD-YY:HH:MM format, defaults to now'"`
 }
 
 var cmdSet *subcmd.CommandSet
@@ -40,7 +50,11 @@ func init() {
 	periodFS := subcmd.MustRegisterFlagStruct(&usageFlags{}, nil, nil)
 	periodCmd := subcmd.NewCommand("usage", periodFS, usageCalculation, subcmd.OptionalSingleArgument())
 	periodCmd.Document("calculate the usage over a given time period.")
-	cmdSet = subcmd.NewCommandSet(dumpCmd, periodCmd)
+
+	registerFS := subcmd.MustRegisterFlagStruct(&registerFlags{}, nil, nil)
+	registerCmd := subcmd.NewCommand("register", registerFS, resyncRegister, subcmd.WithoutArguments())
+	registerCmd.Document("resync a meter's register with a reading of the physical meter, the running pulsemon will use the new reading. Requires --config and --meter.")
+	cmdSet = subcmd.NewCommandSet(dumpCmd, periodCmd, registerCmd)
 }
 
 func main() {
@@ -49,6 +63,19 @@ func main() {
 
 }
 
+// meterConfig returns the configuration for the meter specified on the
+// command line, if any.
+func meterConfig(cl *CommonFlags) (*internal.MeterConfig, error) {
+	if len(cl.Meter) == 0 {
+		return nil, nil
+	}
+	var config internal.Configuration
+	if err := internal.ReadConfig(cl.Config, &config); err != nil {
+		return nil, err
+	}
+	return config.Meter(cl.Meter)
+}
+
 func parseDateOrTime(d string, def time.Time, loc *time.Location) (time.Time, error) {
 	if len(d) == 0 {
 		return def, nil
@@ -69,7 +96,18 @@ func parseDate(d string, def time.Time, loc *time.Location) (time.Time, error) {
 
 func dumpTimestamps(ctx context.Context, values interface{}, args []string) error {
 	cl := values.(*dumpFlags)
-	ts := "-"
+	meter, err := meterConfig(&cl.CommonFlags)
+	if err != nil {
+		return err
+	}
+	ts, widths := "-", cl.Widths
+	if meter != nil {
+		ts = meter.PulseTimestampFile
+		if len(widths) == 0 {
+			widths = meter.PulseWidthsFile
+		}
+		fmt.Printf("# meter: %v (%v per pulse: %v)\n", meter.Name, meter.Units, meter.UnitsPerPulse)
+	}
 	if len(args) > 0 {
 		ts = args[0]
 	}
@@ -86,7 +124,15 @@ func dumpTimestamps(ctx context.Context, values interface{}, args []string) erro
 	if err != nil {
 		return fmt.Errorf("failed to parse end date: %v", err)
 	}
-	return internal.ReadTimestamps(ts, start, end)
+	opts := internal.DumpOptions{WidthsFile: widths}
+	if meter != nil && len(meter.RegisterFile) > 0 {
+		opts.Register, err = internal.ReadRegisterAnchor(meter.RegisterFile)
+		if err != nil {
+			return err
+		}
+		opts.UnitsPerPulse = meter.UnitsPerPulse
+	}
+	return internal.ReadTimestamps(ts, start, end, opts)
 }
 
 func usageCalculation(ctx context.Context, values interface{}, args []string) error {
@@ -97,10 +143,24 @@ func usageCalculation(ctx context.Context, values interface{}, args []string) er
 		return err
 	}
 
-	ts := os.Stdin
+	meter, err := meterConfig(&cl.CommonFlags)
+	if err != nil {
+		return err
+	}
+	filename := ""
+	if meter != nil {
+		filename = meter.PulseTimestampFile
+		cl.UnitsPerPulse = meter.UnitsPerPulse
+		fmt.Printf("# meter: %v (%v per pulse: %v)\n", meter.Name, meter.Units, meter.UnitsPerPulse)
+	}
 	if len(args) > 0 {
+		filename = args[0]
+	}
+
+	ts := os.Stdin
+	if len(filename) > 0 {
 		var err error
-		ts, err = os.Open(args[0])
+		ts, err = os.Open(filename)
 		if err != nil {
 			return err
 		}
@@ -119,15 +179,29 @@ func usageCalculation(ctx context.Context, values interface{}, args []string) er
 		return fmt.Errorf("failed to parse end date: %v", err)
 	}
 
+	var register *internal.RegisterAnchor
+	if meter != nil && len(meter.RegisterFile) > 0 {
+		register, err = internal.ReadRegisterAnchor(meter.RegisterFile)
+		if err != nil {
+			return err
+		}
+	}
+
 	var (
 		pulses        = 0
 		totalPulses   = 0
+		index         = int64(0)
 		nextPeriodEnd time.Time
 	)
 
-	fmt.Printf("date\tpulses\nunits\ttotal-pulses\ttotal-units\ncumulative-units")
+	if register != nil {
+		fmt.Printf("date\tpulses\tunits\ttotal-pulses\ttotal-units\tregister\n")
+	} else {
+		fmt.Printf("date\tpulses\tunits\ttotal-pulses\ttotal-units\n")
+	}
 	sc := internal.NewTimestampFileScanner(ts)
 	for sc.Scan() {
+		index++
 		ns := sc.Time()
 		if start.After(ns) || end.Before(ns) {
 			continue
@@ -138,8 +212,12 @@ func usageCalculation(ctx context.Context, values interface{}, args []string) er
 		pulses++
 		totalPulses++
 		if ns.After(nextPeriodEnd) {
-			fmt.Printf("%v\t%v\t%v\t%v\t%v\n", nextPeriodEnd.Format("01/02/06:15:04"), pulses, pulses*cl.UnitsPerPulse,
-				totalPulses, totalPulses*cl.UnitsPerPulse)
+			fmt.Printf("%v\t%v\t%v\t%v\t%v", nextPeriodEnd.Format("01/02/06:15:04"), pulses, internal.FormatVolume(float64(pulses)*cl.UnitsPerPulse),
+				totalPulses, internal.FormatVolume(float64(totalPulses)*cl.UnitsPerPulse))
+			if register != nil {
+				fmt.Printf("\t%.1f", register.Register(index, cl.UnitsPerPulse))
+			}
+			fmt.Println()
 			nextPeriodEnd = nextPeriodEnd.Add(period)
 			pulses = 0
 		}
@@ -149,3 +227,36 @@ func usageCalculation(ctx context.Context, values interface{}, args []string) er
 	}
 	return nil
 }
+
+func resyncRegister(ctx context.Context, values interface{}, args []string) error {
+	cl := values.(*registerFlags)
+	meter, err := meterConfig(&cl.CommonFlags)
+	if err != nil {
+		return err
+	}
+	if meter == nil || len(meter.RegisterFile) == 0 {
+		return fmt.Errorf("--config and --meter must specify a meter with a register_file")
+	}
+	location, err := time.LoadLocation(cl.TimeZoneLocation)
+	if err != nil {
+		return err
+	}
+	at, err := parseDateOrTime(cl.At, time.Now(), location)
+	if err != nil {
+		return fmt.Errorf("failed to parse time of reading: %v", err)
+	}
+	anchor, err := internal.NewRegisterAnchor(meter.PulseTimestampFile, cl.Reading, at)
+	if err != nil {
+		return err
+	}
+	if prev, err := internal.ReadRegisterAnchor(meter.RegisterFile); err == nil {
+		tracked := prev.Register(anchor.Pulses, meter.UnitsPerPulse)
+		fmt.Printf("%v: tracked register %.1f, physical register %.1f, drift %.1f %v\n",
+			meter.Name, tracked, cl.Reading, tracked-cl.Reading, meter.Units)
+	}
+	if err := internal.WriteRegisterAnchor(meter.RegisterFile, anchor); err != nil {
+		return err
+	}
+	fmt.Printf("%v: register set to %.1f @ %v (%v pulses)\n", meter.Name, anchor.Reading, anchor.Time, anchor.Pulses)
+	return nil
+}